@@ -3,6 +3,7 @@ module github.com/skirrund/gcloud-plugins
 go 1.25.0
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/apache/pulsar-client-go v0.19.0
 	github.com/bytedance/sonic v1.15.0
 	github.com/cloudwego/hertz v0.10.4
@@ -10,6 +11,7 @@ require (
 	github.com/gofiber/fiber/v3 v3.1.0
 	github.com/nacos-group/nacos-sdk-go/v2 v2.3.5
 	github.com/nats-io/nats.go v1.51.0
+	github.com/prometheus/client_golang v1.22.0
 	github.com/skirrund/gcloud v0.14.12
 	github.com/skirrund/hertz-http2 v0.0.5
 	github.com/spf13/viper v1.21.0
@@ -100,7 +102,6 @@ require (
 	github.com/philhofer/fwd v1.2.0 // indirect
 	github.com/pierrec/lz4/v4 v4.1.22 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/prometheus/client_golang v1.22.0 // indirect
 	github.com/prometheus/client_model v0.6.2 // indirect
 	github.com/prometheus/common v0.65.0 // indirect
 	github.com/prometheus/procfs v0.17.0 // indirect
@@ -14,8 +14,10 @@ import (
 
 	"github.com/bytedance/sonic"
 	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/adaptor"
 	"github.com/gofiber/fiber/v3/middleware/recover"
 	"github.com/skirrund/gcloud-plugins/http/server/gfiber/middleware"
+	"github.com/skirrund/gcloud-plugins/metrics"
 	"github.com/skirrund/gcloud/logger"
 	"github.com/skirrund/gcloud/response"
 	"github.com/skirrund/gcloud/server"
@@ -368,3 +370,11 @@ func GetTraceContext(ctx fiber.Ctx) context.Context {
 	}
 	return context.Background()
 }
+
+// RegisterMetrics 在 path 上输出 metrics.Registry 中的 prometheus 指标，path 为空时使用 metrics.DefaultPath，需要在 routerProvider 中调用
+func RegisterMetrics(engine *fiber.App, path string) {
+	if len(path) == 0 {
+		path = metrics.DefaultPath
+	}
+	engine.Get(path, adaptor.HTTPHandler(metrics.Handler()))
+}
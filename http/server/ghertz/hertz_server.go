@@ -15,9 +15,11 @@ import (
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/app/middlewares/server/recovery"
 	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/cloudwego/hertz/pkg/common/adaptor"
 	"github.com/cloudwego/hertz/pkg/common/config"
 	"github.com/cloudwego/hertz/pkg/protocol"
 	"github.com/skirrund/gcloud-plugins/http/server/ghertz/middleware"
+	"github.com/skirrund/gcloud-plugins/metrics"
 	"github.com/skirrund/gcloud/logger"
 	"github.com/skirrund/gcloud/response"
 	gServer "github.com/skirrund/gcloud/server"
@@ -334,3 +336,11 @@ func GetTraceContext(ctx *app.RequestContext) context.Context {
 	id := string(ctx.GetHeader(tracer.TraceIDKey))
 	return tracer.NewContextFromTraceId(id)
 }
+
+// RegisterMetrics 在 path 上输出 metrics.Registry 中的 prometheus 指标，path 为空时使用 metrics.DefaultPath
+func RegisterMetrics(engine *server.Hertz, path string) {
+	if len(path) == 0 {
+		path = metrics.DefaultPath
+	}
+	engine.GET(path, adaptor.HertzHandler(metrics.Handler()))
+}
@@ -0,0 +1,171 @@
+// Package bridge 从一个 mq.IClient 订阅并转发到另一个 mq.IClient，用于 nats 与 pulsar 之间的迁移和镜像
+package bridge
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"strings"
+	"sync"
+
+	"github.com/skirrund/gcloud-plugins/mq/gnats"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud-plugins/mq/pulsar"
+	"github.com/skirrund/gcloud/bootstrap/env"
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/mq"
+	"github.com/skirrund/gcloud/utils"
+)
+
+const (
+	DefaultSubscriptionName = "gcloud-bridge"
+	// TopicPlaceholder Rule.Target 中替换为源 topic 的占位符
+	TopicPlaceholder = "{topic}"
+)
+
+type Options struct {
+	// Rules 逗号分隔的 source=>target，target 为空时与源 topic 相同，如 orders=>orders.{topic},payments=>
+	Rules string `property:"mq.bridge.rules"`
+	// SubscriptionName 源订阅名，默认 DefaultSubscriptionName
+	SubscriptionName string `property:"mq.bridge.subscriptionName"`
+	// RetryTimes 转发失败的重试次数，为0时使用源插件的默认值
+	RetryTimes uint64 `property:"mq.bridge.retryTimes"`
+	// TrimPrefix 替换 {topic} 前从源 topic 去掉的前缀，如 persistent://public/default/
+	TrimPrefix            string `property:"mq.bridge.trimPrefix"`
+	MaxMessageChannelSize int    `property:"mq.bridge.maxMessageChannelSize"`
+	// Stream 源为 nats 时订阅的 stream
+	Stream string `property:"mq.bridge.nats.stream"`
+}
+
+// Rule 订阅 Source 并转发到 Target
+type Rule struct {
+	Source string
+	Target string
+}
+
+// LoadOptions 从配置 mq.bridge.* 读取 Options
+func LoadOptions() Options {
+	opts := Options{}
+	utils.NewOptions(env.GetInstance(), &opts)
+	return opts
+}
+
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if len(r) == 0 {
+			continue
+		}
+		source, target, _ := strings.Cut(r, "=>")
+		source = strings.TrimSpace(source)
+		if len(source) == 0 {
+			return nil, errors.New("[bridge] invalid rule:" + r)
+		}
+		rules = append(rules, Rule{Source: source, Target: strings.TrimSpace(target)})
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("[bridge] mq.bridge.rules is empty")
+	}
+	return rules, nil
+}
+
+type Bridge struct {
+	source mq.IClient
+	target mq.IClient
+	opts   Options
+	rules  []Rule
+	once   sync.Once
+}
+
+// New source 专用于 Bridge，mq.IClient 不能单独取消订阅，Stop 时关闭 source 停止转发
+func New(source, target mq.IClient, opts Options) (*Bridge, error) {
+	rules, err := ParseRules(opts.Rules)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.SubscriptionName) == 0 {
+		opts.SubscriptionName = DefaultSubscriptionName
+	}
+	return &Bridge{source: source, target: target, opts: opts, rules: rules}, nil
+}
+
+// NewFromConfig 使用 LoadOptions 读取的配置
+func NewFromConfig(source, target mq.IClient) (*Bridge, error) {
+	return New(source, target, LoadOptions())
+}
+
+// Start 为每条规则订阅源 topic，转发成功后才确认，失败按源插件的重试配置重新投递；
+// 延迟消息由源端到期后才投递，转发时不再保留延迟。订阅失败时调用 Stop 取消已创建的订阅
+func (b *Bridge) Start() error {
+	for _, rule := range b.rules {
+		opts := mq.ConsumerOptions{
+			Topic:                 rule.Source,
+			SubscriptionName:      b.opts.SubscriptionName,
+			ACKMode:               mq.ACK_MANUAL,
+			RetryTimes:            b.opts.RetryTimes,
+			MaxMessageChannelSize: b.opts.MaxMessageChannelSize,
+			MessageListener: func(ctx context.Context, msg *mq.Message) error {
+				return b.forward(ctx, rule, msg)
+			},
+		}
+		opts.NatsOpts.Stream = b.opts.Stream
+		logger.Info("[bridge]start:", rule.Source, "=>", b.targetTopic(rule, rule.Source))
+		if err := b.source.Subscribe(opts); err != nil {
+			logger.Error("[bridge]subscribe error:", rule.Source, ",", err.Error())
+			b.Stop()
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop 关闭源客户端，等待正在转发的消息处理完成后返回
+func (b *Bridge) Stop() {
+	b.once.Do(func() {
+		logger.Info("[bridge]stop")
+		b.source.Close()
+	})
+}
+
+func (b *Bridge) forward(ctx context.Context, rule Rule, msg *mq.Message) error {
+	out := &mq.Message{
+		Topic:   b.targetTopic(rule, msg.Topic),
+		Payload: msg.Payload,
+		Header:  convertHeader(msg.Header),
+	}
+	if err := b.target.Send(out); err != nil {
+		logger.ErrorContext(ctx, "[bridge]forward error:", msg.Topic, "=>", out.Topic, ",", err.Error())
+		return err
+	}
+	return nil
+}
+
+func (b *Bridge) targetTopic(rule Rule, topic string) string {
+	if len(rule.Target) == 0 {
+		return topic
+	}
+	return strings.ReplaceAll(rule.Target, TopicPlaceholder, strings.TrimPrefix(topic, b.opts.TrimPrefix))
+}
+
+// convertHeader 保留 header，并在 pulsar key 与 nats order key 之间互相补全；
+// 未设置消息 ID 时使用 pulsar 消息 ID，重复转发时目标端可以去重
+func convertHeader(h map[string]string) map[string]string {
+	header := maps.Clone(h)
+	if header == nil {
+		header = make(map[string]string)
+	}
+	key, orderKey := header[pulsar.KeyHeader], header[gnats.DefaultOrderKeyHeader]
+	if len(key) > 0 && len(orderKey) == 0 {
+		header[gnats.DefaultOrderKeyHeader] = key
+	} else if len(orderKey) > 0 && len(key) == 0 {
+		header[pulsar.KeyHeader] = orderKey
+	}
+	if id := header[pulsar.MessageIdHeader]; len(id) > 0 {
+		if len(header[mqutil.MsgIdHeader]) == 0 {
+			header[mqutil.MsgIdHeader] = id
+		}
+		delete(header, pulsar.MessageIdHeader)
+	}
+	return header
+}
@@ -0,0 +1,112 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/skirrund/gcloud-plugins/mq/gnats"
+	"github.com/skirrund/gcloud-plugins/mq/memmq"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud-plugins/mq/pulsar"
+	"github.com/skirrund/gcloud/mq"
+)
+
+func TestBridge(t *testing.T) {
+	source, target := memmq.New(), memmq.New()
+	defer source.Close()
+	defer target.Close()
+	b, err := New(source, target, Options{
+		Rules:      "persistent://public/default/orders=>orders.{topic}, payments=>",
+		TrimPrefix: "persistent://public/default/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	msg := &mq.Message{Topic: "persistent://public/default/orders", Payload: []byte("created"), Header: map[string]string{pulsar.MessageIdHeader: "id-1"}}
+	pulsar.SetKey(msg, "order-1")
+	source.Send(msg)
+	source.Send(&mq.Message{Topic: "payments", Payload: []byte("paid")})
+	source.AssertAcked(t, "", 2)
+
+	target.AssertSent(t, "payments", 1)
+	sent := target.Sent("orders.orders")
+	if len(sent) != 1 {
+		t.Fatalf("orders sent=%d", len(sent))
+	}
+	h := sent[0].Header
+	if h[gnats.DefaultOrderKeyHeader] != "order-1" || h[mqutil.MsgIdHeader] != "id-1" || len(h[pulsar.MessageIdHeader]) > 0 {
+		t.Errorf("header=%v", h)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	if _, err := ParseRules(" , "); err == nil {
+		t.Error("empty rules should fail")
+	}
+	if _, err := ParseRules("=>orders"); err == nil {
+		t.Error("empty source should fail")
+	}
+}
+
+type failingClient struct {
+	*memmq.Broker
+	fails int
+}
+
+func (c *failingClient) Send(msg *mq.Message) error {
+	if c.fails > 0 {
+		c.fails--
+		return errors.New("unavailable")
+	}
+	return c.Broker.Send(msg)
+}
+
+func TestBridgeRetry(t *testing.T) {
+	source, target := memmq.New(), &failingClient{Broker: memmq.New(), fails: 2}
+	defer source.Close()
+	defer target.Close()
+	b, err := New(source, target, Options{Rules: "orders=>", RetryTimes: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	source.Send(&mq.Message{Topic: "orders", Payload: []byte("created")})
+	source.AssertAcked(t, "orders", 1)
+	target.AssertSent(t, "orders", 1)
+}
+
+// subscribeFailing 第 n 次订阅失败
+type subscribeFailing struct {
+	*memmq.Broker
+	n int
+}
+
+func (c *subscribeFailing) Subscribe(opts mq.ConsumerOptions) error {
+	if c.n--; c.n == 0 {
+		return errors.New("subscribe failed")
+	}
+	return c.Broker.Subscribe(opts)
+}
+
+func TestBridgeStartError(t *testing.T) {
+	source, target := &subscribeFailing{Broker: memmq.New(), n: 2}, memmq.New()
+	defer target.Close()
+	b, err := New(source, target, Options{Rules: "orders=>,payments=>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Start(); err == nil {
+		t.Fatal("start should fail")
+	}
+	// 已创建的订阅随源客户端关闭
+	if err = source.Send(&mq.Message{Topic: "orders"}); !errors.Is(err, memmq.ErrClosed) {
+		t.Errorf("source should be closed:%v", err)
+	}
+	b.Stop()
+	target.AssertSent(t, "orders", 0)
+}
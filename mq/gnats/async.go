@@ -0,0 +1,102 @@
+package gnats
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/mq"
+)
+
+const (
+	DefaultPublishAsyncTimeout = 30 * time.Second
+	DefaultCloseFlushTimeout   = 5 * time.Second
+)
+
+// PublishResult 异步发送被 stream 存储后的确认信息
+type PublishResult struct {
+	Stream    string
+	Sequence  uint64
+	Duplicate bool
+}
+
+// PublishFuture 异步发送的结果
+type PublishFuture struct {
+	f nats.PubAckFuture
+}
+
+// Wait 等待发送确认，超过 Option.PublishAsyncTimeout 未确认时返回 nats.ErrAsyncPublishTimeout
+func (pf *PublishFuture) Wait(ctx context.Context) (*PublishResult, error) {
+	select {
+	case ack := <-pf.f.Ok():
+		return &PublishResult{Stream: ack.Stream, Sequence: ack.Sequence, Duplicate: ack.Duplicate}, nil
+	case err := <-pf.f.Err():
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func jetStreamOptions(opt Option) []nats.JSOpt {
+	var opts []nats.JSOpt
+	if opt.PublishAsyncMaxPending > 0 {
+		opts = append(opts, nats.PublishAsyncMaxPending(opt.PublishAsyncMaxPending))
+	}
+	timeout := opt.PublishAsyncTimeout
+	if timeout <= 0 {
+		timeout = DefaultPublishAsyncTimeout
+	}
+	opts = append(opts, nats.PublishAsyncTimeout(timeout))
+	return opts
+}
+
+// SendAsyncFuture 异步发送并返回 PublishFuture，未确认的消息达到 Option.PublishAsyncMaxPending 时阻塞，
+// 超过 Option.PublishAsyncStallWait 仍未恢复则返回 nats.ErrTooManyStalledMsgs
+func (nc *natsConn) SendAsyncFuture(msg *mq.Message) (*PublishFuture, error) {
+	nm, opts := createMsg(msg)
+	if nc.stallWait > 0 {
+		opts = append(opts, nats.StallWait(nc.stallWait))
+	}
+	f, err := nc.js.PublishMsgAsync(nm, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &PublishFuture{f: f}, nil
+}
+
+// SendAsyncWithCallback 异步发送，确认或失败后调用 cb
+func (nc *natsConn) SendAsyncWithCallback(msg *mq.Message, cb func(res *PublishResult, err error)) error {
+	start := time.Now()
+	f, err := nc.SendAsyncFuture(msg)
+	topic := msg.Topic
+	if err != nil {
+		mqutil.Metrics.Published(mqutil.SystemNats, topic, start, err)
+		return err
+	}
+	go func() {
+		res, err := f.Wait(context.Background())
+		mqutil.Metrics.Published(mqutil.SystemNats, topic, start, err)
+		if err != nil {
+			logger.Error("[nats]SendAsync error:", topic, ",", err.Error())
+		}
+		if cb != nil {
+			cb(res, err)
+		}
+	}()
+	return nil
+}
+
+// Flush 等待所有异步发送被确认
+func (nc *natsConn) Flush(ctx context.Context) error {
+	if err := nc.conn.FlushWithContext(ctx); err != nil {
+		return err
+	}
+	select {
+	case <-nc.js.PublishAsyncComplete():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
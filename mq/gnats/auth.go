@@ -0,0 +1,87 @@
+package gnats
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+
+	"github.com/nats-io/nats.go"
+)
+
+// authOptions 根据 Option 生成认证和 TLS 相关的 nats.Option，配置冲突或文件不可读时返回错误
+func authOptions(opt Option) ([]nats.Option, error) {
+	var opts []nats.Option
+	methods := 0
+	if len(opt.User) > 0 {
+		methods++
+	}
+	if len(opt.Token) > 0 {
+		methods++
+	}
+	if len(opt.CredsFile) > 0 {
+		methods++
+	}
+	if len(opt.NKeySeedFile) > 0 {
+		methods++
+	}
+	if methods > 1 {
+		return nil, errors.New("[nats] only one of nats.user, nats.token, nats.credsFile, nats.nkeySeedFile can be set")
+	}
+	switch {
+	case len(opt.User) > 0:
+		opts = append(opts, nats.UserInfo(opt.User, opt.Password))
+	case len(opt.Token) > 0:
+		opts = append(opts, nats.Token(opt.Token))
+	case len(opt.CredsFile) > 0:
+		if err := checkFile("nats.credsFile", opt.CredsFile); err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.UserCredentials(opt.CredsFile))
+	case len(opt.NKeySeedFile) > 0:
+		if err := checkFile("nats.nkeySeedFile", opt.NKeySeedFile); err != nil {
+			return nil, err
+		}
+		o, err := nats.NkeyOptionFromSeed(opt.NKeySeedFile)
+		if err != nil {
+			return nil, errors.New("[nats] invalid nats.nkeySeedFile:" + err.Error())
+		}
+		opts = append(opts, o)
+	}
+
+	if (len(opt.TLSCert) > 0) != (len(opt.TLSKey) > 0) {
+		return nil, errors.New("[nats] nats.tls.cert and nats.tls.key must be set together")
+	}
+	if opt.TLSRequired || len(opt.TLSCA) > 0 || len(opt.TLSCert) > 0 {
+		opts = append(opts, nats.Secure(&tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: opt.TLSInsecureSkipVerify,
+		}))
+	}
+	if len(opt.TLSCA) > 0 {
+		if err := checkFile("nats.tls.ca", opt.TLSCA); err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.RootCAs(opt.TLSCA))
+	}
+	if len(opt.TLSCert) > 0 {
+		if err := checkFile("nats.tls.cert", opt.TLSCert); err != nil {
+			return nil, err
+		}
+		if err := checkFile("nats.tls.key", opt.TLSKey); err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.ClientCert(opt.TLSCert, opt.TLSKey))
+	}
+	return opts, nil
+}
+
+func checkFile(key, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return errors.New("[nats] " + key + " can not be read:" + err.Error())
+	}
+	if fi.IsDir() {
+		return errors.New("[nats] " + key + " is a directory:" + path)
+	}
+	return nil
+}
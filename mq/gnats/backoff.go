@@ -0,0 +1,144 @@
+package gnats
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff 计算第 redeliveryCount 次投递失败后的 NAK 延迟，redeliveryCount 从 1 开始
+type Backoff interface {
+	Next(redeliveryCount uint64) time.Duration
+}
+
+type BackoffFunc func(redeliveryCount uint64) time.Duration
+
+func (f BackoffFunc) Next(redeliveryCount uint64) time.Duration {
+	return f(redeliveryCount)
+}
+
+// MaxBackoff 未设置 max 时的延迟上限，溢出时也返回该值
+const MaxBackoff = 24 * time.Hour
+
+// DefaultBackoff 保持原有的 2n-1 秒线性退避
+var DefaultBackoff Backoff = LinearBackoff(time.Second, 2*time.Second, 0)
+
+func FixedBackoff(delay time.Duration) Backoff {
+	return BackoffFunc(func(uint64) time.Duration {
+		return delay
+	})
+}
+
+// LinearBackoff initial + (n-1)*step，max>0 时封顶，否则最大 MaxBackoff
+func LinearBackoff(initial, step, max time.Duration) Backoff {
+	return BackoffFunc(func(n uint64) time.Duration {
+		if n == 0 {
+			n = 1
+		}
+		return capDelay(float64(initial)+float64(n-1)*float64(step), max)
+	})
+}
+
+// ExponentialBackoff initial * multiplier^(n-1)，max>0 时封顶，否则最大 MaxBackoff；jitter 取值 [0,1]，按比例随机减少延迟
+func ExponentialBackoff(initial, max time.Duration, multiplier, jitter float64) Backoff {
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	jitter = math.Min(math.Max(jitter, 0), 1)
+	return BackoffFunc(func(n uint64) time.Duration {
+		if n == 0 {
+			n = 1
+		}
+		d := capDelay(float64(initial)*math.Pow(multiplier, float64(n-1)), max)
+		if jitter > 0 && d > 0 {
+			d -= time.Duration(rand.Float64() * jitter * float64(d))
+		}
+		return d
+	})
+}
+
+// ScheduleBackoff 按列表依次取延迟，超出列表长度后一直使用最后一个
+func ScheduleBackoff(delays ...time.Duration) Backoff {
+	return BackoffFunc(func(n uint64) time.Duration {
+		if len(delays) == 0 {
+			return 0
+		}
+		if n == 0 {
+			n = 1
+		}
+		idx := min(n-1, uint64(len(delays)-1))
+		return delays[idx]
+	})
+}
+
+// capDelay 在 float64 上比较，避免转换为 time.Duration 时溢出为负数
+func capDelay(f float64, max time.Duration) time.Duration {
+	if max <= 0 {
+		max = MaxBackoff
+	}
+	if math.IsNaN(f) || f >= float64(max) {
+		return max
+	}
+	if f < 0 {
+		return 0
+	}
+	return time.Duration(f)
+}
+
+// RetryError 由 MessageListener 返回，指定本次重试的延迟，仍受 RetryTimes 限制
+type RetryError struct {
+	Err   error
+	Delay time.Duration
+}
+
+func (e *RetryError) Error() string {
+	if e.Err == nil {
+		return "retry after " + e.Delay.String()
+	}
+	return e.Err.Error()
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// NoRetryError 由 MessageListener 返回，消息不再重试
+type NoRetryError struct {
+	Err error
+}
+
+func (e *NoRetryError) Error() string {
+	if e.Err == nil {
+		return "no retry"
+	}
+	return e.Err.Error()
+}
+
+func (e *NoRetryError) Unwrap() error {
+	return e.Err
+}
+
+func RetryAfter(err error, delay time.Duration) error {
+	return &RetryError{Err: err, Delay: delay}
+}
+
+func NoRetry(err error) error {
+	return &NoRetryError{Err: err}
+}
+
+// retryDelay 返回本次 NAK 的延迟以及是否允许重试
+func retryDelay(err error, backoff Backoff, redeliveryCount uint64) (time.Duration, bool) {
+	var noRetry *NoRetryError
+	if errors.As(err, &noRetry) {
+		return 0, false
+	}
+	var retry *RetryError
+	if errors.As(err, &retry) {
+		return retry.Delay, true
+	}
+	if backoff == nil {
+		backoff = DefaultBackoff
+	}
+	return backoff.Next(redeliveryCount), true
+}
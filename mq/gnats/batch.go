@@ -0,0 +1,79 @@
+package gnats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/mq"
+	"github.com/skirrund/gcloud/tracer"
+)
+
+func newBatchDispatcher(opts ConsumerOptions) dispatcher {
+	bo := opts.Batch.WithDefaults()
+	b := mqutil.NewBatcher(bo.MaxSize, bo.MaxWait, func(msgs []*nats.Msg) {
+		consumeBatch(msgs, opts, bo.Listener)
+	})
+	return b.Add
+}
+
+func consumeBatch(msgs []*nats.Msg, opts ConsumerOptions, listener mqutil.BatchListener) {
+	logCtx := tracer.NewTraceIDContext()
+	defer func() {
+		if e := recover(); e != nil {
+			logger.ErrorContext(logCtx, "[nats] batch consumer panic recover :", e, "\n", string(debug.Stack()))
+		}
+	}()
+	deliveries := make([]*delivery, 0, len(msgs))
+	for _, msg := range msgs {
+		if d := safeDelivery(logCtx, msg, opts); d != nil {
+			deliveries = append(deliveries, d)
+		}
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	messages := make([]*mq.Message, len(deliveries))
+	for i, d := range deliveries {
+		messages[i] = d.message
+	}
+	logger.InfofContext(logCtx, "[nats] consumer batch=>subName:%s,size:%d", opts.SubscriptionName, len(messages))
+	var errs []error
+	start := time.Now()
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				logger.ErrorContext(logCtx, "[nats] batch consumer panic recover :", e, "\n", string(debug.Stack()))
+				err := errors.New(fmt.Sprint("[nats] batch consumer panic:", e))
+				errs = make([]error, len(messages))
+				for i := range errs {
+					errs[i] = err
+				}
+			}
+		}()
+		errs = listener(logCtx, messages)
+	}()
+	for i := range messages {
+		mqutil.Metrics.Handled(mqutil.SystemNats, opts.Topic, opts.SubscriptionName, start, mqutil.BatchResult(errs, i))
+	}
+	for i, d := range deliveries {
+		d.finish(logCtx, opts, mqutil.BatchResult(errs, i))
+	}
+}
+
+// safeDelivery 单条消息解析 panic 时 NAK 该消息，不影响同批次的其他消息
+func safeDelivery(logCtx context.Context, msg *nats.Msg, opts ConsumerOptions) (d *delivery) {
+	defer func() {
+		if e := recover(); e != nil {
+			logger.ErrorContext(logCtx, "[nats] batch consumer delivery panic recover :", e, "\n", string(debug.Stack()))
+			msg.Nak()
+			d = nil
+		}
+	}()
+	return newDelivery(logCtx, msg, opts)
+}
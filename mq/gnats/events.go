@@ -0,0 +1,100 @@
+package gnats
+
+import (
+	"errors"
+
+	"github.com/nats-io/nats.go"
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/server"
+)
+
+const (
+	DisconnectedEvent      server.EventName = "nats.disconnected"
+	ReconnectedEvent       server.EventName = "nats.reconnected"
+	ClosedEvent            server.EventName = "nats.closed"
+	DiscoveredServersEvent server.EventName = "nats.discoveredServers"
+	SlowConsumerEvent      server.EventName = "nats.slowConsumer"
+	AsyncErrorEvent        server.EventName = "nats.asyncError"
+)
+
+// ConnectionEvent 通过 server.EmitEvent 发出的连接事件信息
+type ConnectionEvent struct {
+	// Name Register 注册的连接名称，NewConnection 创建的连接为空
+	Name    string
+	AppName string
+	Url     string
+	Servers []string
+	Subject string
+	Err     error
+}
+
+func eventOptions(name string, opt Option) []nats.Option {
+	newEvent := func(c *nats.Conn, err error) ConnectionEvent {
+		return ConnectionEvent{
+			Name:    name,
+			AppName: opt.AppName,
+			Url:     c.ConnectedUrl(),
+			Servers: c.Servers(),
+			Err:     err,
+		}
+	}
+	return []nats.Option{
+		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			e := newEvent(c, err)
+			logger.Error("[nats]disconnected=>name:", name, ",appName:", opt.AppName, ",err:", err)
+			server.EmitEvent(DisconnectedEvent, e)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			e := newEvent(c, nil)
+			logger.Info("[nats]reconnected=>name:", name, ",appName:", opt.AppName, ",url:", e.Url)
+			server.EmitEvent(ReconnectedEvent, e)
+		}),
+		nats.ClosedHandler(func(c *nats.Conn) {
+			e := newEvent(c, c.LastError())
+			logger.Info("[nats]closed=>name:", name, ",appName:", opt.AppName, ",err:", e.Err)
+			server.EmitEvent(ClosedEvent, e)
+		}),
+		nats.DiscoveredServersHandler(func(c *nats.Conn) {
+			e := newEvent(c, nil)
+			e.Servers = c.DiscoveredServers()
+			logger.Info("[nats]discovered servers=>name:", name, ",appName:", opt.AppName, ",servers:", e.Servers)
+			server.EmitEvent(DiscoveredServersEvent, e)
+		}),
+		nats.ErrorHandler(func(c *nats.Conn, sub *nats.Subscription, err error) {
+			e := newEvent(c, err)
+			pending := 0
+			if sub != nil {
+				e.Subject = sub.Subject
+				pending, _, _ = sub.Pending()
+			}
+			if errors.Is(err, nats.ErrSlowConsumer) {
+				logger.Error("[nats]slow consumer=>name:", name, ",appName:", opt.AppName, ",subject:", e.Subject, ",pending:", pending)
+				server.EmitEvent(SlowConsumerEvent, e)
+				return
+			}
+			logger.Error("[nats]async error=>name:", name, ",appName:", opt.AppName, ",subject:", e.Subject, ",err:", err)
+			server.EmitEvent(AsyncErrorEvent, e)
+		}),
+	}
+}
+
+func reconnectOptions(opt Option) []nats.Option {
+	var opts []nats.Option
+	if opt.ReconnectWait > 0 {
+		opts = append(opts, nats.ReconnectWait(opt.ReconnectWait))
+	}
+	if opt.MaxReconnects != 0 {
+		opts = append(opts, nats.MaxReconnects(opt.MaxReconnects))
+	}
+	if opt.ReconnectBufSize != 0 {
+		opts = append(opts, nats.ReconnectBufSize(opt.ReconnectBufSize))
+	}
+	if opt.ReconnectJitter > 0 || opt.ReconnectJitterTLS > 0 {
+		jitterTLS := opt.ReconnectJitterTLS
+		if jitterTLS <= 0 {
+			jitterTLS = opt.ReconnectJitter
+		}
+		opts = append(opts, nats.ReconnectJitter(opt.ReconnectJitter, jitterTLS))
+	}
+	return opts
+}
@@ -0,0 +1,157 @@
+package gnats
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	DefaultIdempotencyTTL          = 24 * time.Hour
+	DefaultIdempotencyClaimTimeout = 5 * time.Minute
+	// idempotencyBusyDelay 同一消息正在被其他投递处理时重新认领的间隔
+	idempotencyBusyDelay = time.Second
+	claimingPrefix       = "processing:"
+)
+
+// IdempotencyOptions 消费端幂等过滤，处理前通过 KV Create 认领消息 ID，成功后标记为已处理，失败时释放；
+// TTL 内重复投递的已处理消息直接确认跳过，正在处理中的等待其完成，不占用重试次数
+type IdempotencyOptions struct {
+	Bucket   string
+	TTL      time.Duration
+	Replicas int
+	// ClaimTimeout 认领后超过该时间仍未完成视为处理者已退出，可被重新认领，默认 DefaultIdempotencyClaimTimeout
+	ClaimTimeout time.Duration
+}
+
+type idempotencyFilter struct {
+	kv           nats.KeyValue
+	sub          string
+	claimTimeout time.Duration
+	busyDelay    time.Duration
+}
+
+type claimResult int
+
+const (
+	claimAcquired claimResult = iota
+	// claimProcessed 已处理过
+	claimProcessed
+	// claimBusy 正在被其他投递处理
+	claimBusy
+)
+
+func (nc *natsConn) newIdempotencyFilter(opts *IdempotencyOptions, subscriptionName string) (*idempotencyFilter, error) {
+	if len(opts.Bucket) == 0 {
+		return nil, errors.New("[nats] idempotency bucket is empty")
+	}
+	ttl := opts.TTL
+	if ttl <= 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+	kv, err := nc.KeyValue(KVOptions{
+		Bucket:      opts.Bucket,
+		AutoCreate:  true,
+		Description: "gnats consumer idempotency",
+		History:     1,
+		TTL:         ttl,
+		Replicas:    opts.Replicas,
+	})
+	if err != nil {
+		return nil, err
+	}
+	claimTimeout := opts.ClaimTimeout
+	if claimTimeout <= 0 {
+		claimTimeout = DefaultIdempotencyClaimTimeout
+	}
+	return &idempotencyFilter{kv: kv, sub: subscriptionName, claimTimeout: claimTimeout, busyDelay: idempotencyBusyDelay}, nil
+}
+
+// msgKey 优先使用 Nats-Msg-Id，否则使用 stream 序号
+func (f *idempotencyFilter) msgKey(msg *nats.Msg, meta *nats.MsgMetadata) string {
+	id := msg.Header.Get(nats.MsgIdHdr)
+	if len(id) == 0 {
+		if meta == nil {
+			return ""
+		}
+		id = meta.Stream + ":" + strconv.FormatUint(meta.Sequence.Stream, 10)
+	}
+	h := sha256.Sum256([]byte(id))
+	return f.sub + "." + hex.EncodeToString(h[:])
+}
+
+// claim 使用 Create 原子地认领 key，KV 出错时返回 claimAcquired 和错误，由调用方继续处理
+func (f *idempotencyFilter) claim(key string) (claimResult, error) {
+	if len(key) == 0 {
+		return claimAcquired, nil
+	}
+	now := time.Now()
+	value := []byte(claimingPrefix + strconv.FormatInt(now.UnixMilli(), 10))
+	_, err := f.kv.Create(key, value)
+	if err == nil {
+		return claimAcquired, nil
+	}
+	if !errors.Is(err, nats.ErrKeyExists) {
+		return claimAcquired, err
+	}
+	entry, err := f.kv.Get(key)
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return claimBusy, nil
+		}
+		return claimAcquired, err
+	}
+	at, claiming := parseClaim(entry.Value())
+	if !claiming {
+		return claimProcessed, nil
+	}
+	if now.Sub(at) < f.claimTimeout {
+		return claimBusy, nil
+	}
+	// 认领已过期，CAS 接管，失败说明已被其他投递接管
+	if _, err = f.kv.Update(key, value, entry.Revision()); err != nil {
+		return claimBusy, nil
+	}
+	return claimAcquired, nil
+}
+
+// waitClaim 消息正在被其他投递处理时定时调用 inProgress 延长 AckWait 并重新认领，直到对方完成、释放或认领过期；
+// 不使用 NAK，避免占用重试次数
+func (f *idempotencyFilter) waitClaim(key string, inProgress func(...nats.AckOpt) error) (claimResult, error) {
+	for {
+		res, err := f.claim(key)
+		if res != claimBusy {
+			return res, err
+		}
+		inProgress()
+		time.Sleep(f.busyDelay)
+	}
+}
+
+// parseClaim 返回认领时间和是否处理中，已处理的值为毫秒时间戳
+func parseClaim(value []byte) (time.Time, bool) {
+	s, claiming := strings.CutPrefix(string(value), claimingPrefix)
+	ms, _ := strconv.ParseInt(s, 10, 64)
+	return time.UnixMilli(ms), claiming
+}
+
+func (f *idempotencyFilter) markProcessed(key string) error {
+	if len(key) == 0 {
+		return nil
+	}
+	_, err := f.kv.Put(key, []byte(strconv.FormatInt(time.Now().UnixMilli(), 10)))
+	return err
+}
+
+// release 处理失败时释放认领，重新投递时可再次认领
+func (f *idempotencyFilter) release(key string) error {
+	if len(key) == 0 {
+		return nil
+	}
+	return f.kv.Delete(key)
+}
@@ -0,0 +1,175 @@
+package gnats
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/skirrund/gcloud/logger"
+)
+
+// KVOptions KeyValue bucket 配置，AutoCreate 为 true 时 bucket 不存在则按配置创建
+type KVOptions struct {
+	Bucket       string
+	AutoCreate   bool
+	Description  string
+	History      uint8
+	TTL          time.Duration
+	MaxBytes     int64
+	MaxValueSize int32
+	Replicas     int
+	Storage      nats.StorageType
+}
+
+func (nc *natsConn) KeyValue(opts KVOptions) (nats.KeyValue, error) {
+	if len(opts.Bucket) == 0 {
+		return nil, errors.New("[nats] kv bucket is empty")
+	}
+	kv, err := nc.js.KeyValue(opts.Bucket)
+	if err == nil || !opts.AutoCreate || !errors.Is(err, nats.ErrBucketNotFound) {
+		return kv, err
+	}
+	logger.Info("[nats]create kv bucket:", opts.Bucket)
+	return nc.js.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket:       opts.Bucket,
+		Description:  opts.Description,
+		History:      opts.History,
+		TTL:          opts.TTL,
+		MaxBytes:     opts.MaxBytes,
+		MaxValueSize: opts.MaxValueSize,
+		Replicas:     opts.Replicas,
+		Storage:      opts.Storage,
+	})
+}
+
+// KV 强类型的 KeyValue 封装，T 为 []byte 或 string 时原样存储，否则 json 序列化
+type KV[T any] struct {
+	kv nats.KeyValue
+}
+
+type KVEntry[T any] struct {
+	Key       string
+	Value     T
+	Revision  uint64
+	Created   time.Time
+	Operation nats.KeyValueOp
+}
+
+func NewKV[T any](c Client, opts KVOptions) (*KV[T], error) {
+	kv, err := c.KeyValue(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &KV[T]{kv: kv}, nil
+}
+
+func (kv *KV[T]) Bucket() string {
+	return kv.kv.Bucket()
+}
+
+// Raw 返回底层 nats.KeyValue
+func (kv *KV[T]) Raw() nats.KeyValue {
+	return kv.kv
+}
+
+// Get key 不存在时返回 nats.ErrKeyNotFound
+func (kv *KV[T]) Get(key string) (KVEntry[T], error) {
+	entry, err := kv.kv.Get(key)
+	if err != nil {
+		return KVEntry[T]{Key: key}, err
+	}
+	return toKVEntry[T](entry)
+}
+
+func (kv *KV[T]) Put(key string, value T) (uint64, error) {
+	data, err := encodeData(value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.kv.Put(key, data)
+}
+
+// Create 仅当 key 不存在时写入，否则返回 nats.ErrKeyExists
+func (kv *KV[T]) Create(key string, value T) (uint64, error) {
+	data, err := encodeData(value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.kv.Create(key, data)
+}
+
+// Update CAS 写入，仅当当前 revision 等于 lastRevision 时成功
+func (kv *KV[T]) Update(key string, value T, lastRevision uint64) (uint64, error) {
+	data, err := encodeData(value)
+	if err != nil {
+		return 0, err
+	}
+	return kv.kv.Update(key, data, lastRevision)
+}
+
+func (kv *KV[T]) Delete(key string) error {
+	return kv.kv.Delete(key)
+}
+
+// Purge 删除 key 及其历史
+func (kv *KV[T]) Purge(key string) error {
+	return kv.kv.Purge(key)
+}
+
+func (kv *KV[T]) Keys() ([]string, error) {
+	keys, err := kv.kv.Keys()
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, nil
+	}
+	return keys, err
+}
+
+// Watch 监听匹配 keys 的变更直到 ctx 结束，keys 支持通配符，为空时监听全部；删除事件的 Value 为零值
+func (kv *KV[T]) Watch(ctx context.Context, keys string, fn func(entry KVEntry[T])) error {
+	if len(keys) == 0 {
+		keys = nats.AllKeys
+	}
+	w, err := kv.kv.Watch(keys, nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer w.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-w.Updates():
+				if !ok {
+					return
+				}
+				// nil 表示初始数据已全部推送
+				if entry == nil {
+					continue
+				}
+				e, err := toKVEntry[T](entry)
+				if err != nil {
+					logger.Error("[nats]kv watch decode error:", entry.Key(), ",", err.Error())
+					continue
+				}
+				fn(e)
+			}
+		}
+	}()
+	return nil
+}
+
+func toKVEntry[T any](entry nats.KeyValueEntry) (KVEntry[T], error) {
+	e := KVEntry[T]{
+		Key:       entry.Key(),
+		Revision:  entry.Revision(),
+		Created:   entry.Created(),
+		Operation: entry.Operation(),
+	}
+	if entry.Operation() != nats.KeyValuePut || len(entry.Value()) == 0 {
+		return e, nil
+	}
+	err := decodeData(entry.Value(), &e.Value)
+	return e, err
+}
@@ -0,0 +1,33 @@
+package gnats
+
+import (
+	"time"
+
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/logger"
+)
+
+// pollConsumerInfo 定时拉取 consumer 的 pending 和 ack pending，同一个 consumer 只会启动一个，未配置 MetricsPollInterval 时不轮询
+func (nc *natsConn) pollConsumerInfo(stream, topic, subscriptionName string) {
+	if nc.metricsPollInterval <= 0 {
+		return
+	}
+	if _, loaded := nc.pollers.LoadOrStore(stream+"/"+subscriptionName, struct{}{}); loaded {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(nc.metricsPollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if nc.conn.IsClosed() {
+				return
+			}
+			info, err := nc.js.ConsumerInfo(stream, subscriptionName)
+			if err != nil {
+				logger.Error("[nats]poll consumer info error:", stream, "=>", subscriptionName, ",", err.Error())
+				continue
+			}
+			mqutil.Metrics.SetPending(mqutil.SystemNats, topic, subscriptionName, info.NumPending, uint64(info.NumAckPending))
+		}
+	}()
+}
@@ -1,19 +1,21 @@
 package gnats
 
 import (
+	"context"
 	"errors"
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
 	"github.com/skirrund/gcloud/bootstrap/env"
 	"github.com/skirrund/gcloud/logger"
 	"github.com/skirrund/gcloud/mq"
 	"github.com/skirrund/gcloud/tracer"
 	"github.com/skirrund/gcloud/utils"
-	"github.com/skirrund/gcloud/utils/worker"
 )
 
 const (
@@ -32,44 +34,79 @@ const (
 )
 
 type natsConn struct {
-	conn    *nats.Conn
-	js      nats.JetStreamContext
-	appName string
+	name           string
+	opt            Option
+	conn           *nats.Conn
+	js             nats.JetStreamContext
+	appName        string
+	requestTimeout time.Duration
+	stallWait      time.Duration
+	// 已启动 consumer 指标轮询的 stream/consumer
+	pollers             sync.Map
+	metricsPollInterval time.Duration
 }
 
-var conn *natsConn
+// Client nats 客户端，除 mq.IClient 外提供 nats 专有的能力
+type Client interface {
+	mq.IClient
+	SubscribeWithOptions(opts ConsumerOptions) error
+	SubscribeWithOptionsSync(opts ConsumerOptions) error
+	Request(ctx context.Context, subject string, req any, resp any) error
+	Serve(subject, queueGroup string, handler RpcHandler) (*nats.Subscription, error)
+	KeyValue(opts KVOptions) (nats.KeyValue, error)
+	ObjectStore(opts ObjectStoreOptions) (*ObjectStore, error)
+	IsConnected() bool
+	SendAsyncFuture(msg *mq.Message) (*PublishFuture, error)
+	SendAsyncWithCallback(msg *mq.Message, cb func(res *PublishResult, err error)) error
+	Flush(ctx context.Context) error
+	SendSchedule(msg *mq.Message, opts ScheduleOptions) (*Schedule, error)
+	CancelSchedule(s *Schedule) error
+	ReplaceSchedule(s *Schedule, msg *mq.Message, opts ScheduleOptions) (*Schedule, error)
+	ListSchedules(stream string) ([]*Schedule, error)
+}
 
-func NewDefaultConnection() (mq.IClient, error) {
+func NewDefaultConnection() (Client, error) {
 	opts := Option{}
 	cfg := env.GetInstance()
 	utils.NewOptions(cfg, &opts)
 	if len(opts.AppName) == 0 {
 		opts.AppName = cfg.GetString(ServerName)
 	}
-	return NewConnection(opts)
+	return Register(DefaultConnectionName, opts)
 }
 
-func NewConnection(opt Option) (mq.IClient, error) {
-	if conn != nil {
-		return conn, nil
-	}
-	nc, err := connect(opt)
+// NewConnection 每次调用都会创建新的连接，需要复用请使用 Register/Get
+func NewConnection(opt Option) (Client, error) {
+	return newConnection("", opt)
+}
+
+func newConnection(name string, opt Option) (*natsConn, error) {
+	nc, err := connect(name, opt)
 	if err != nil {
-		return conn, err
+		return nil, err
 	}
-	js, err := nc.JetStream()
+	js, err := nc.JetStream(jetStreamOptions(opt)...)
 	if err != nil {
-		return conn, err
+		nc.Close()
+		return nil, err
 	}
-	conn = &natsConn{
-		conn:    nc,
-		appName: opt.AppName,
-		js:      js,
+	requestTimeout := opt.RequestTimeout
+	if requestTimeout <= 0 {
+		requestTimeout = DefaultRequestTimeout
 	}
-	return conn, err
+	return &natsConn{
+		name:                name,
+		opt:                 opt,
+		conn:                nc,
+		appName:             opt.AppName,
+		js:                  js,
+		requestTimeout:      requestTimeout,
+		stallWait:           opt.PublishAsyncStallWait,
+		metricsPollInterval: opt.MetricsPollInterval,
+	}, nil
 }
 
-func connect(opt Option) (*nats.Conn, error) {
+func connect(name string, opt Option) (*nats.Conn, error) {
 	var opts []nats.Option
 	if opt.Timeout > 0 {
 		opts = append(opts, nats.Timeout(opt.Timeout))
@@ -77,9 +114,14 @@ func connect(opt Option) (*nats.Conn, error) {
 	if len(opt.AppName) > 0 {
 		opts = append(opts, nats.Name(opt.AppName))
 	}
-	if len(opt.User) > 0 {
-		opts = append(opts, nats.UserInfo(opt.User, opt.Password))
+	authOpts, err := authOptions(opt)
+	if err != nil {
+		logger.Error("[nats]connect options error:", err.Error())
+		return nil, err
 	}
+	opts = append(opts, authOpts...)
+	opts = append(opts, reconnectOptions(opt)...)
+	opts = append(opts, eventOptions(name, opt)...)
 	if opt.MaxPingsOutstanding > 0 {
 		opts = append(opts, nats.MaxPingsOutstanding(opt.MaxPingsOutstanding))
 	}
@@ -103,31 +145,37 @@ func (nc *natsConn) SendAsync(msg *mq.Message) error {
 
 func (nc *natsConn) doSendSync(msg *mq.Message) error {
 	nm, opts := createMsg(msg)
-	if _, err := nc.js.PublishMsg(nm, opts...); err != nil {
+	start := time.Now()
+	ack, err := nc.js.PublishMsg(nm, opts...)
+	mqutil.Metrics.Published(mqutil.SystemNats, msg.Topic, start, err)
+	if err != nil {
 		return err
 	}
+	if ack.Duplicate {
+		logger.Info("[nats]duplicate message ignored by stream:", ack.Stream, ",msgId:", nm.Header.Get(nats.MsgIdHdr))
+	}
 	return nil
 }
 
 func (nc *natsConn) doSendAsync(msg *mq.Message) error {
-	nm, opts := createMsg(msg)
-	if _, err := nc.js.PublishMsgAsync(nm, opts...); err != nil {
-		return err
-	}
-	return nil
+	return nc.SendAsyncWithCallback(msg, nil)
 }
 
-func getScheduleSubject(stream string, deliverAt time.Time, deliverAfter time.Duration) (subject, schedule string) {
-	subject = stream + ScheduleSubjectSubfix + utils.Uuid()
+func getSchedule(deliverAt time.Time, deliverAfter time.Duration) (schedule string) {
 	if deliverAt.Compare(time.Now()) > 0 {
-		schedule = ScheduleAt + deliverAt.Format(time.RFC3339)
+		schedule = ScheduleAtSpec(deliverAt)
 	} else if deliverAfter > 0 {
-		schedule = ScheduleAt + time.Now().Add(deliverAfter).Format(time.RFC3339)
+		schedule = ScheduleAtSpec(time.Now().Add(deliverAfter))
 	}
 	return
 }
 
 func createMsg(msg *mq.Message) (natsMsg *nats.Msg, opts []nats.PubOpt) {
+	return buildMsg(msg, getSchedule(msg.DeliverAt, msg.DeliverAfter), "")
+}
+
+// buildMsg schedule 非空时发送到 <stream>.schedules.<scheduleName> 由服务端按 schedule 投递到 topic，scheduleName 为空时随机生成
+func buildMsg(msg *mq.Message, schedule, scheduleName string) (natsMsg *nats.Msg, opts []nats.PubOpt) {
 	subject := strings.ReplaceAll(msg.Topic, "/", "-")
 	stream := msg.NatsOpts.Stream
 	if len(stream) == 0 {
@@ -140,27 +188,43 @@ func createMsg(msg *mq.Message) (natsMsg *nats.Msg, opts []nats.PubOpt) {
 		Data:    msg.Payload,
 		Subject: subject,
 	}
-	if msg.DeliverAfter > 0 || msg.DeliverAt.Compare(time.Now()) > 0 {
-		scheduleSubject, schedule := getScheduleSubject(stream, msg.DeliverAt, msg.DeliverAfter)
+	if len(schedule) > 0 {
+		if len(scheduleName) == 0 {
+			scheduleName = utils.Uuid()
+		}
 		header.Set(NatsSchedule, schedule)
 		header.Set(NatsScheduleTarget, subject)
-		natsMsg.Subject = scheduleSubject
+		natsMsg.Subject = stream + ScheduleSubjectSubfix + scheduleName
 	}
 	if len(msg.Header) > 0 {
 		for k, v := range msg.Header {
 			header.Set(k, v)
 		}
 	}
+	if id := header.Get(mqutil.MsgIdHeader); len(id) > 0 {
+		header.Del(mqutil.MsgIdHeader)
+		if len(header.Get(nats.MsgIdHdr)) == 0 {
+			header.Set(nats.MsgIdHdr, id)
+		}
+	}
 	natsMsg.Header = header
 	return
 }
 
 func (nc *natsConn) Subscribe(opts mq.ConsumerOptions) error {
+	return nc.SubscribeWithOptions(ConsumerOptions{ConsumerOptions: opts})
+}
+
+func (nc *natsConn) SubscribeSync(opts mq.ConsumerOptions) error {
+	return nc.SubscribeWithOptionsSync(ConsumerOptions{ConsumerOptions: opts})
+}
+
+func (nc *natsConn) SubscribeWithOptions(opts ConsumerOptions) error {
 	go nc.doSubscribe(opts)
 	return nil
 }
 
-func (nc *natsConn) SubscribeSync(opts mq.ConsumerOptions) error {
+func (nc *natsConn) SubscribeWithOptionsSync(opts ConsumerOptions) error {
 	return nc.doSubscribe(opts)
 }
 
@@ -170,7 +234,10 @@ func doPanic(canPanic bool, err error) {
 	}
 }
 
-func (nc *natsConn) doSubscribe(opts mq.ConsumerOptions) error {
+func (nc *natsConn) doSubscribe(opts ConsumerOptions) error {
+	if opts.Partition != nil {
+		return nc.partitionSubscribe(opts)
+	}
 	subject := strings.ReplaceAll(opts.Topic, "/", "-")
 	stream := opts.NatsOpts.Stream
 	if len(stream) == 0 {
@@ -184,6 +251,9 @@ func (nc *natsConn) doSubscribe(opts mq.ConsumerOptions) error {
 	if opts.RetryTimes == 0 {
 		opts.RetryTimes = MAX_RETRY_TIMES
 	}
+	if opts.Backoff == nil {
+		opts.Backoff = DefaultBackoff
+	}
 	channelSize := opts.MaxMessageChannelSize
 	if channelSize == 0 {
 		channelSize = 200
@@ -194,6 +264,14 @@ func (nc *natsConn) doSubscribe(opts mq.ConsumerOptions) error {
 		pullBatchSize = DefaultPullBatchSize
 	}
 	opts.NatsOpts.PullBatchSize = pullBatchSize
+	if opts.Idempotency != nil {
+		filter, err := nc.newIdempotencyFilter(opts.Idempotency, subscriptionName)
+		if err != nil {
+			doPanic(opts.IsErrorPanic, err)
+			return err
+		}
+		opts.idempotency = filter
+	}
 	info, err := nc.js.ConsumerInfo(stream, subscriptionName)
 	if err != nil {
 		doPanic(opts.IsErrorPanic, err)
@@ -214,15 +292,23 @@ func (nc *natsConn) doSubscribe(opts mq.ConsumerOptions) error {
 			// 	return err
 			// }
 		}
+		nc.pollConsumerInfo(stream, subject, subscriptionName)
+		if opts.Mode == ConsumeModeOrdered && cfg.MaxAckPending != 1 {
+			logger.Info("[nats]ordered consumer should set MaxAckPending=1:", stream, "=>", subscriptionName)
+		}
 		//pull
 		if len(cfg.DeliverGroup) == 0 {
-			numcpu := min(runtime.NumCPU(), 4)
-			for range numcpu - 1 {
-				go nc.pullSubscribe(opts, info.Config)
+			dispatch := newDispatcher(opts, false)
+			// 有序消费只能有一个拉取协程
+			if opts.Mode == ConsumeModeConcurrent {
+				numcpu := min(runtime.NumCPU(), 4)
+				for range numcpu - 1 {
+					go nc.pullSubscribe(opts, info.Config, dispatch)
+				}
 			}
-			return nc.pullSubscribe(opts, info.Config)
+			return nc.pullSubscribe(opts, info.Config, dispatch)
 		} else {
-			return nc.pushSubscribe(opts, info.Config)
+			return nc.pushSubscribe(opts, info.Config, newDispatcher(opts, true))
 		}
 	} else {
 		errMsg := "nats get consumer nil:" + opts.NatsOpts.Stream + "=>" + opts.SubscriptionName
@@ -232,7 +318,7 @@ func (nc *natsConn) doSubscribe(opts mq.ConsumerOptions) error {
 		return err
 	}
 }
-func (nc *natsConn) pushSubscribe(opts mq.ConsumerOptions, cfg nats.ConsumerConfig) error {
+func (nc *natsConn) pushSubscribe(opts ConsumerOptions, cfg nats.ConsumerConfig, dispatch dispatcher) error {
 	subscriptionName := opts.SubscriptionName
 	topic := opts.Topic
 	channelSize := opts.MaxMessageChannelSize
@@ -249,11 +335,11 @@ func (nc *natsConn) pushSubscribe(opts mq.ConsumerOptions, cfg nats.ConsumerConf
 		return err
 	}
 	for msg := range msgsChan {
-		go consume(msg, opts)
+		dispatch(msg)
 	}
 	return nil
 }
-func (nc *natsConn) pullSubscribe(opts mq.ConsumerOptions, cfg nats.ConsumerConfig) error {
+func (nc *natsConn) pullSubscribe(opts ConsumerOptions, cfg nats.ConsumerConfig, dispatch dispatcher) error {
 	subscriptionName := opts.SubscriptionName
 	topic := opts.Topic
 	sub, err := nc.js.PullSubscribe(topic, subscriptionName, nats.Bind(opts.NatsOpts.Stream, subscriptionName), nats.ManualAck())
@@ -263,55 +349,154 @@ func (nc *natsConn) pullSubscribe(opts mq.ConsumerOptions, cfg nats.ConsumerConf
 		return err
 	}
 	pullBatchSize := opts.NatsOpts.PullBatchSize
-	execWorker := worker.Init(pullBatchSize * 2)
 	for {
-		batch, _ := sub.FetchBatch(pullBatchSize)
+		batch, err := sub.FetchBatch(pullBatchSize)
+		if err != nil {
+			logger.Error("[nats]FetchBatch error:", err.Error())
+			if errors.Is(err, nats.ErrConnectionClosed) || errors.Is(err, nats.ErrBadSubscription) {
+				return err
+			}
+			time.Sleep(time.Second)
+			continue
+		}
 		for msg := range batch.Messages() {
-			execWorker.Execute(func() {
-				consume(msg, opts)
-			})
+			dispatch(msg)
 		}
 	}
 }
-func consume(msg *nats.Msg, opts mq.ConsumerOptions) {
-	logCtx := tracer.NewTraceIDContext()
-	defer func() {
-		if err := recover(); err != nil {
-			logger.ErrorContext(logCtx, "[nats] consumer panic recover :", err, "\n", string(debug.Stack()))
-		}
-	}()
+
+// delivery 一条待处理的消息
+type delivery struct {
+	msg            *nats.Msg
+	message        *mq.Message
+	idempotencyKey string
+}
+
+// newDelivery 解析元数据，已被处理过或无法解析元数据的消息处理后返回 nil
+func newDelivery(logCtx context.Context, msg *nats.Msg, opts ConsumerOptions) *delivery {
 	metaData, err := msg.Metadata()
 	if err != nil {
-		logger.ErrorContext(logCtx, "[nats] consumer Metadata error :", err.Error())
+		logger.ErrorContext(logCtx, "[nats] consumer Metadata error :", msg.Subject, ",", err.Error())
+		msg.Term()
+		mqutil.Metrics.DeadLettered(mqutil.SystemNats, opts.Topic, opts.SubscriptionName)
+		return nil
 	}
 	data := msg.Data
-	msgStr := string(data)
-	logger.InfoContext(logCtx, "[nats] consumer msg:", msgStr)
 	redeliveryCount := metaData.NumDelivered
-	logger.InfofContext(logCtx, "[nats] consumer info=>subName:%s,reDeliveryCount:%d,publishTime:%s,topic:%s", opts.SubscriptionName, metaData.NumDelivered, metaData.Timestamp.Format(time.DateTime), msg.Subject)
-	err = opts.MessageListener(logCtx, &mq.Message{
+	if logOpts := mqutil.OrDefault(opts.Log); logOpts.Sampled() {
+		logger.InfoContext(logCtx, "[nats] consumer msg:", logOpts.Format(data))
+		logger.InfofContext(logCtx, "[nats] consumer info=>subName:%s,reDeliveryCount:%d,publishTime:%s,topic:%s", opts.SubscriptionName, metaData.NumDelivered, metaData.Timestamp.Format(time.DateTime), msg.Subject)
+	}
+	mqutil.Metrics.Received(mqutil.SystemNats, opts.Topic, opts.SubscriptionName, redeliveryCount)
+	d := &delivery{msg: msg}
+	if opts.idempotency != nil {
+		d.idempotencyKey = opts.idempotency.msgKey(msg, metaData)
+		res, err := opts.idempotency.waitClaim(d.idempotencyKey, msg.InProgress)
+		if err != nil {
+			logger.ErrorContext(logCtx, "[nats] consumer idempotency claim error:", err.Error())
+		}
+		if res == claimProcessed {
+			logger.InfoContext(logCtx, "[nats] consumer skip processed msg:", msg.Header.Get(nats.MsgIdHdr))
+			msg.Ack()
+			return nil
+		}
+	}
+	d.message = &mq.Message{
+		Topic:           msg.Subject,
 		Payload:         data,
+		Header:          toMqHeader(msg.Header),
 		RedeliveryCount: redeliveryCount,
 		SubOpts:         mq.SubOpts{Name: opts.SubscriptionName},
-	})
+	}
+	return d
+}
+
+func consume(msg *nats.Msg, opts ConsumerOptions) {
+	logCtx := tracer.NewTraceIDContext()
+	defer func() {
+		if err := recover(); err != nil {
+			logger.ErrorContext(logCtx, "[nats] consumer panic recover :", err, "\n", string(debug.Stack()))
+		}
+	}()
+	d := newDelivery(logCtx, msg, opts)
+	if d == nil {
+		return
+	}
+	start := time.Now()
+	err := opts.MessageListener(logCtx, d.message)
+	mqutil.Metrics.Handled(mqutil.SystemNats, opts.Topic, opts.SubscriptionName, start, err)
+	d.finish(logCtx, opts, err)
+}
+
+// finish 根据处理结果 ack 或 nak
+func (d *delivery) finish(logCtx context.Context, opts ConsumerOptions, err error) {
+	msg := d.msg
+	redeliveryCount := d.message.RedeliveryCount
 	if err == nil {
+		if opts.idempotency != nil {
+			if e := opts.idempotency.markProcessed(d.idempotencyKey); e != nil {
+				logger.ErrorContext(logCtx, "[nats] consumer mark processed error:", e.Error())
+			}
+		}
 		msg.Ack()
+		mqutil.Metrics.Acked(mqutil.SystemNats, opts.Topic, opts.SubscriptionName)
 	} else {
 		logger.ErrorContext(logCtx, "[nats] consumer error:"+err.Error())
+		if opts.idempotency != nil {
+			if e := opts.idempotency.release(d.idempotencyKey); e != nil {
+				logger.ErrorContext(logCtx, "[nats] consumer release idempotency claim error:", e.Error())
+			}
+		}
+		if logOpts := mqutil.OrDefault(opts.Log); logOpts.LogOnError() {
+			logger.ErrorContext(logCtx, "[nats] consumer error msg:", msg.Subject, ",", logOpts.Format(msg.Data))
+		}
 		retryTimes := uint64(0)
 		retryTimes = min(opts.RetryTimes, MAX_RETRY_TIMES)
 		ackMode := opts.ACKMode
-		if ackMode == mq.ACK_MANUAL && redeliveryCount < retryTimes {
-			msg.NakWithDelay(time.Duration(2*redeliveryCount-1) * time.Second)
-			logger.InfofContext(logCtx, "[nats]consummer error and retry=> subscriptionName:"+opts.SubscriptionName+",initRetryTimes:%d,retryTimes:%d,ack:%d", retryTimes, redeliveryCount, ackMode)
+		delay, canRetry := retryDelay(err, opts.Backoff, redeliveryCount)
+		if !canRetry {
+			msg.Term()
+			mqutil.Metrics.DeadLettered(mqutil.SystemNats, opts.Topic, opts.SubscriptionName)
+			logger.InfofContext(logCtx, "[nats]consummer error and no retry=> subscriptionName:"+opts.SubscriptionName+",retryTimes:%d,ack:%d", redeliveryCount, ackMode)
+		} else if ackMode == mq.ACK_MANUAL && redeliveryCount < retryTimes {
+			msg.NakWithDelay(delay)
+			mqutil.Metrics.Nacked(mqutil.SystemNats, opts.Topic, opts.SubscriptionName)
+			logger.InfofContext(logCtx, "[nats]consummer error and retry=> subscriptionName:"+opts.SubscriptionName+",initRetryTimes:%d,retryTimes:%d,ack:%d,delay:%s", retryTimes, redeliveryCount, ackMode, delay)
 		} else {
 			msg.Ack()
+			mqutil.Metrics.DeadLettered(mqutil.SystemNats, opts.Topic, opts.SubscriptionName)
 			logger.InfofContext(logCtx, "[nats]consummer error and can not retry=> subscriptionName:"+opts.SubscriptionName+",initRetryTimes:%d,retryTimes:%d,ack:%d", retryTimes, redeliveryCount, ackMode)
 		}
 
 	}
 }
 
+func toMqHeader(h nats.Header) map[string]string {
+	if len(h) == 0 {
+		return nil
+	}
+	header := make(map[string]string, len(h))
+	for k := range h {
+		header[k] = h.Get(k)
+	}
+	if id := h.Get(nats.MsgIdHdr); len(id) > 0 {
+		header[mqutil.MsgIdHeader] = id
+	}
+	return header
+}
+
+func (nc *natsConn) IsConnected() bool {
+	return nc.conn.IsConnected()
+}
+
 func (nc *natsConn) Close() {
+	if len(nc.name) > 0 {
+		unregister(nc)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCloseFlushTimeout)
+	defer cancel()
+	if err := nc.Flush(ctx); err != nil {
+		logger.Error("[nats]flush pending async publish before close error:", err.Error())
+	}
 	nc.conn.Drain()
 }
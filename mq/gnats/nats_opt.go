@@ -1,6 +1,11 @@
 package gnats
 
-import "time"
+import (
+	"time"
+
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/mq"
+)
 
 type Option struct {
 	Url                 string        `property:"nats.url"`
@@ -9,4 +14,51 @@ type Option struct {
 	AppName             string        `property:"nats.appName"`
 	Timeout             time.Duration `property:"nats.timeout"`
 	MaxPingsOutstanding int           `property:"nats.maxPingsOutstanding"`
+	RequestTimeout      time.Duration `property:"nats.requestTimeout"`
+	// User、Token、CredsFile、NKeySeedFile 只能配置一种
+	Token        string `property:"nats.token"`
+	CredsFile    string `property:"nats.credsFile"`
+	NKeySeedFile string `property:"nats.nkeySeedFile"`
+	// TLS 证书路径，配置任意一个即启用 TLS
+	TLSCA                 string        `property:"nats.tls.ca"`
+	TLSCert               string        `property:"nats.tls.cert"`
+	TLSKey                string        `property:"nats.tls.key"`
+	TLSRequired           bool          `property:"nats.tls.required"`
+	TLSInsecureSkipVerify bool          `property:"nats.tls.insecureSkipVerify"`
+	ReconnectWait         time.Duration `property:"nats.reconnectWait"`
+	// MaxReconnects 小于0时无限重连，0 使用 nats 默认值
+	MaxReconnects int `property:"nats.maxReconnects"`
+	// ReconnectBufSize 重连期间缓冲的发布字节数，小于0时不缓冲
+	ReconnectBufSize   int           `property:"nats.reconnectBufSize"`
+	ReconnectJitter    time.Duration `property:"nats.reconnectJitter"`
+	ReconnectJitterTLS time.Duration `property:"nats.reconnectJitterTLS"`
+	// PublishAsyncMaxPending 未确认的异步发送上限，超过后 SendAsync 阻塞，0 使用 nats 默认值
+	PublishAsyncMaxPending int           `property:"nats.publishAsyncMaxPending"`
+	PublishAsyncStallWait  time.Duration `property:"nats.publishAsyncStallWait"`
+	PublishAsyncTimeout    time.Duration `property:"nats.publishAsyncTimeout"`
+	// MetricsPollInterval consumer pending 指标的轮询间隔，大于0时启用，如 30s
+	MetricsPollInterval time.Duration `property:"nats.metricsPollInterval"`
+}
+
+// ConsumerOptions 在 mq.ConsumerOptions 基础上增加 nats 专有的订阅配置
+type ConsumerOptions struct {
+	mq.ConsumerOptions
+	// Backoff NAK 重试延迟策略，为空时使用 DefaultBackoff
+	Backoff Backoff
+	// Idempotency 非空时启用基于 KV 的幂等过滤
+	Idempotency *IdempotencyOptions
+	idempotency *idempotencyFilter
+	// Mode 消费模式，默认并发消费
+	Mode ConsumeMode
+	// Lanes ConsumeModeKeyOrdered 的处理通道数，默认等于 PullBatchSize
+	Lanes          int
+	OrderKeyHeader string
+	// OrderKeyField ConsumeModeKeyOrdered 从 json payload 中读取 key 的字段，以 . 分隔
+	OrderKeyField string
+	// Partition 非空时按分区消费，未指定 Mode 时各分区按 ConsumeModeOrdered 消费
+	Partition *PartitionOptions
+	// Batch 非空时使用 Batch.Listener 批量处理，忽略 MessageListener 和 Mode
+	Batch *mqutil.BatchOptions
+	// Log payload 日志配置，为空时使用 mqutil.DefaultLogOptions
+	Log *mqutil.LogOptions
 }
@@ -2,13 +2,19 @@ package gnats
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/skirrund/gcloud/mq"
+	"github.com/skirrund/gcloud/tracer"
 	"github.com/skirrund/gcloud/utils"
 )
 
@@ -108,3 +114,466 @@ func OnMessage1(ctx context.Context, msg *mq.Message) error {
 func TestTTT(test *testing.T) {
 	fmt.Println(time.Now().Format(time.RFC3339))
 }
+
+func TestBackoff(t *testing.T) {
+	for n, want := range map[uint64]time.Duration{1: time.Second, 2: 3 * time.Second, 5: 9 * time.Second} {
+		if d := DefaultBackoff.Next(n); d != want {
+			t.Errorf("DefaultBackoff.Next(%d)=%s,want %s", n, d, want)
+		}
+	}
+	eb := ExponentialBackoff(time.Second, 10*time.Second, 2, 0)
+	if d := eb.Next(3); d != 4*time.Second {
+		t.Errorf("ExponentialBackoff.Next(3)=%s", d)
+	}
+	if d := eb.Next(10); d != 10*time.Second {
+		t.Errorf("ExponentialBackoff.Next(10)=%s", d)
+	}
+	for _, tc := range []struct {
+		backoff Backoff
+		n       uint64
+		want    time.Duration
+	}{
+		{ExponentialBackoff(time.Second, 0, 2, 0), 64, MaxBackoff},
+		{ExponentialBackoff(time.Second, 0, 2, 0), 1 << 40, MaxBackoff},
+		{ExponentialBackoff(time.Second, time.Minute, 2, 0), 100, time.Minute},
+		{LinearBackoff(time.Second, time.Hour, 0), 1 << 62, MaxBackoff},
+		{LinearBackoff(time.Second, time.Hour, 5*time.Hour), 1 << 62, 5 * time.Hour},
+	} {
+		if d := tc.backoff.Next(tc.n); d != tc.want {
+			t.Errorf("Next(%d)=%s,want %s", tc.n, d, tc.want)
+		}
+	}
+	sb := ScheduleBackoff(time.Second, 5*time.Second)
+	if d := sb.Next(4); d != 5*time.Second {
+		t.Errorf("ScheduleBackoff.Next(4)=%s", d)
+	}
+	if d, ok := retryDelay(RetryAfter(errors.New("busy"), time.Minute), sb, 1); !ok || d != time.Minute {
+		t.Errorf("RetryAfter delay=%s,retry=%v", d, ok)
+	}
+	if _, ok := retryDelay(fmt.Errorf("wrap:%w", NoRetry(errors.New("bad"))), sb, 1); ok {
+		t.Error("NoRetry should not retry")
+	}
+}
+
+func TestAuthOptions(t *testing.T) {
+	if _, err := authOptions(Option{User: "u", Token: "t"}); err == nil {
+		t.Error("user and token should conflict")
+	}
+	if _, err := authOptions(Option{TLSCert: "cert.pem"}); err == nil {
+		t.Error("tls cert without key should fail")
+	}
+	if _, err := authOptions(Option{CredsFile: "not-exists.creds"}); err == nil {
+		t.Error("missing creds file should fail")
+	}
+	opts, err := authOptions(Option{Token: "t", TLSRequired: true})
+	if err != nil || len(opts) != 2 {
+		t.Errorf("token with tls:%d,%v", len(opts), err)
+	}
+}
+
+func TestValidateScheduleSpec(t *testing.T) {
+	valid := []string{ScheduleAtSpec(time.Now().Add(time.Minute)), ScheduleEverySpec(5 * time.Minute), "@hourly", "0 30 9 * * MON-FRI"}
+	for _, spec := range valid {
+		if err := ValidateScheduleSpec(spec); err != nil {
+			t.Errorf("%s:%v", spec, err)
+		}
+	}
+	invalid := []string{"", "@at tomorrow", "@every 10ms", "@sometimes", "*/5 * * * *"}
+	for _, spec := range invalid {
+		if err := ValidateScheduleSpec(spec); err == nil {
+			t.Errorf("%s should be invalid", spec)
+		}
+	}
+	s := &Schedule{Stream: "test-schedule", Subject: "test-schedule.schedules.order-1"}
+	if s.Name() != "order-1" {
+		t.Errorf("Schedule.Name()=%s", s.Name())
+	}
+}
+
+func TestPartition(t *testing.T) {
+	p := &PartitionOptions{Partitions: 8, PodIndex: 1, PodCount: 3}
+	assigned, err := p.assigned()
+	if err != nil || fmt.Sprint(assigned) != "[1 4 7]" {
+		t.Errorf("assigned=%v,%v", assigned, err)
+	}
+	if _, err := (&PartitionOptions{Partitions: 4, Assigned: []int{4}}).assigned(); err == nil {
+		t.Error("out of range partition should fail")
+	}
+	if Partition("order-1", 8) != Partition("order-1", 8) {
+		t.Error("partition should be stable")
+	}
+	key, ok := payloadField([]byte(`{"order":{"id":1001}}`), "order.id")
+	if !ok || key != "1001" {
+		t.Errorf("payloadField=%s,%v", key, ok)
+	}
+}
+
+// blockingJS 分区 0 的 ConsumerInfo 一直阻塞，模拟正常运行的订阅，其他分区返回错误
+type blockingJS struct {
+	nats.JetStreamContext
+	block chan struct{}
+}
+
+func (js *blockingJS) ConsumerInfo(stream, name string, opts ...nats.JSOpt) (*nats.ConsumerInfo, error) {
+	if strings.HasSuffix(name, "-0") {
+		<-js.block
+	}
+	return nil, errors.New("consumer not found:" + name)
+}
+
+func TestPartitionSubscribeError(t *testing.T) {
+	js := &blockingJS{block: make(chan struct{})}
+	defer close(js.block)
+	nc := &natsConn{js: js}
+	done := make(chan error, 1)
+	go func() {
+		done <- nc.partitionSubscribe(ConsumerOptions{
+			ConsumerOptions: mq.ConsumerOptions{Topic: "test-partition", SubscriptionName: "sub"},
+			Partition:       &PartitionOptions{Partitions: 2},
+		})
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "sub-1") {
+			t.Errorf("err=%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("partition error should be returned while other partitions are running")
+	}
+}
+
+func TestRpc(t *testing.T) {
+	type order struct {
+		Id   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	data, err := encodeData(order{Id: 1, Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o order
+	if err = decodeData(data, &o); err != nil || o.Id != 1 || o.Name != "a" {
+		t.Errorf("decode order=%+v,%v", o, err)
+	}
+	var raw []byte
+	if data, _ = encodeData("pong"); decodeData(data, &raw) != nil || string(raw) != "pong" {
+		t.Errorf("raw=%s", raw)
+	}
+	if data, err = encodeData(nil); data != nil || err != nil {
+		t.Errorf("nil data=%v,%v", data, err)
+	}
+
+	if id := getTraceId(nil); id != "" {
+		t.Errorf("nil ctx traceId=%s", id)
+	}
+	if id := getTraceId(context.Background()); id != "" {
+		t.Errorf("empty ctx traceId=%s", id)
+	}
+	if id := getTraceId(context.WithValue(context.Background(), tracer.TraceIDKey, "trace-1")); id != "trace-1" {
+		t.Errorf("traceId=%s", id)
+	}
+
+	ctx := context.Background()
+	msg := &nats.Msg{Subject: "rpc.order", Reply: "_INBOX.1", Data: []byte(`{"id":2}`)}
+	reply := handleMsg(ctx, msg, TypedHandler(func(ctx context.Context, req *order) (order, error) {
+		req.Name = "b"
+		return *req, nil
+	}))
+	if string(reply.Data) != `{"id":2,"name":"b"}` || len(reply.Header.Get(RpcErrorCodeHeader)) > 0 {
+		t.Errorf("reply=%s,header=%v", reply.Data, reply.Header)
+	}
+	msg.Data = []byte("{")
+	reply = handleMsg(ctx, msg, TypedHandler(func(ctx context.Context, req *order) (order, error) {
+		return *req, nil
+	}))
+	if reply.Header.Get(RpcErrorCodeHeader) != strconv.Itoa(RpcBadRequestCode) || reply.Data != nil {
+		t.Errorf("bad request header=%v", reply.Header)
+	}
+	reply = handleMsg(ctx, msg, func(ctx context.Context, msg *nats.Msg) (any, error) {
+		return nil, errors.New("line1\nline2")
+	})
+	if reply.Header.Get(RpcErrorCodeHeader) != strconv.Itoa(RpcInternalErrorCode) || reply.Header.Get(RpcErrorMsgHeader) != "line1 line2" {
+		t.Errorf("error header=%v", reply.Header)
+	}
+	reply = handleMsg(ctx, msg, func(ctx context.Context, msg *nats.Msg) (any, error) {
+		panic("boom")
+	})
+	if reply.Header.Get(RpcErrorCodeHeader) != strconv.Itoa(RpcInternalErrorCode) || reply.Header.Get(RpcErrorMsgHeader) != "boom" {
+		t.Errorf("panic header=%v", reply.Header)
+	}
+	msg.Reply = ""
+	if reply = handleMsg(ctx, msg, func(ctx context.Context, msg *nats.Msg) (any, error) { return "ok", nil }); reply != nil {
+		t.Error("publish without reply should not respond")
+	}
+}
+
+type kvEntry struct {
+	key   string
+	value []byte
+	op    nats.KeyValueOp
+	rev   uint64
+}
+
+func (e kvEntry) Bucket() string             { return "test" }
+func (e kvEntry) Key() string                { return e.key }
+func (e kvEntry) Value() []byte              { return e.value }
+func (e kvEntry) Revision() uint64           { return e.rev }
+func (e kvEntry) Created() time.Time         { return time.Time{} }
+func (e kvEntry) Delta() uint64              { return 0 }
+func (e kvEntry) Operation() nats.KeyValueOp { return e.op }
+
+func TestKVEntry(t *testing.T) {
+	type config struct {
+		Enabled bool `json:"enabled"`
+	}
+	e, err := toKVEntry[config](kvEntry{key: "feature", value: []byte(`{"enabled":true}`), op: nats.KeyValuePut, rev: 3})
+	if err != nil || !e.Value.Enabled || e.Key != "feature" || e.Revision != 3 {
+		t.Errorf("entry=%+v,%v", e, err)
+	}
+	s, err := toKVEntry[string](kvEntry{key: "name", value: []byte("gcloud"), op: nats.KeyValuePut})
+	if err != nil || s.Value != "gcloud" {
+		t.Errorf("string entry=%+v,%v", s, err)
+	}
+	d, err := toKVEntry[config](kvEntry{key: "feature", value: []byte("ignored"), op: nats.KeyValueDelete})
+	if err != nil || d.Value.Enabled || d.Operation != nats.KeyValueDelete {
+		t.Errorf("delete entry=%+v,%v", d, err)
+	}
+	if _, err = toKVEntry[config](kvEntry{key: "feature", value: []byte("{"), op: nats.KeyValuePut}); err == nil {
+		t.Error("invalid json should fail")
+	}
+	if _, err = (&natsConn{}).KeyValue(KVOptions{}); err == nil {
+		t.Error("empty bucket should fail")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	opt := Option{Url: "nats://localhost:4222", AppName: "test"}
+	nc := &natsConn{name: "test-register", opt: opt}
+	connMu.Lock()
+	connections[nc.name] = nc
+	connMu.Unlock()
+	defer unregister(nc)
+	if c, err := Register(nc.name, opt); err != nil || c != nc {
+		t.Errorf("same option should return registered connection:%v", err)
+	}
+	opt.Url = "nats://other:4222"
+	if _, err := Register(nc.name, opt); err == nil {
+		t.Error("different option should fail")
+	}
+}
+
+func TestRegisterOutsideLock(t *testing.T) {
+	// 只接受连接不响应，连接会阻塞到超时
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := Register("test-slow", Option{Url: "nats://" + l.Addr().String(), Timeout: time.Second})
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	got := make(chan struct{})
+	go func() {
+		Get("test-other")
+		close(got)
+	}()
+	select {
+	case <-got:
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Get blocked by a slow Register")
+	}
+	if err = <-done; err == nil {
+		t.Error("connect to a silent server should fail")
+	}
+}
+
+func TestConnectionOptions(t *testing.T) {
+	o := nats.GetDefaultOptions()
+	for _, fn := range reconnectOptions(Option{ReconnectWait: 3 * time.Second, MaxReconnects: -1, ReconnectBufSize: -1, ReconnectJitter: time.Second}) {
+		if err := fn(&o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if o.ReconnectWait != 3*time.Second || o.MaxReconnect != -1 || o.ReconnectBufSize != -1 || o.ReconnectJitter != time.Second || o.ReconnectJitterTLS != time.Second {
+		t.Errorf("reconnect options=%+v", o)
+	}
+	if opts := reconnectOptions(Option{}); len(opts) != 0 {
+		t.Errorf("empty option should use nats defaults:%d", len(opts))
+	}
+	for _, fn := range eventOptions("test", Option{AppName: "test"}) {
+		if err := fn(&o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if o.DisconnectedErrCB == nil || o.ReconnectedCB == nil || o.ClosedCB == nil || o.DiscoveredServersCB == nil || o.AsyncErrorCB == nil {
+		t.Error("event handlers should be set")
+	}
+}
+
+type pubAckFuture struct {
+	ok  chan *nats.PubAck
+	err chan error
+}
+
+func (f *pubAckFuture) Ok() <-chan *nats.PubAck { return f.ok }
+func (f *pubAckFuture) Err() <-chan error       { return f.err }
+func (f *pubAckFuture) Msg() *nats.Msg          { return nil }
+
+func TestPublishFuture(t *testing.T) {
+	f := &pubAckFuture{ok: make(chan *nats.PubAck, 1), err: make(chan error, 1)}
+	pf := &PublishFuture{f: f}
+	f.ok <- &nats.PubAck{Stream: "test", Sequence: 7, Duplicate: true}
+	res, err := pf.Wait(context.Background())
+	if err != nil || res.Stream != "test" || res.Sequence != 7 || !res.Duplicate {
+		t.Errorf("result=%+v,%v", res, err)
+	}
+	f.err <- nats.ErrAsyncPublishTimeout
+	if _, err = pf.Wait(context.Background()); !errors.Is(err, nats.ErrAsyncPublishTimeout) {
+		t.Errorf("err=%v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = pf.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled err=%v", err)
+	}
+	if opts := jetStreamOptions(Option{PublishAsyncMaxPending: 10}); len(opts) != 2 {
+		t.Errorf("jetStreamOptions=%d", len(opts))
+	}
+}
+
+// memKV 只实现幂等过滤用到的方法
+type memKV struct {
+	nats.KeyValue
+	mu      sync.Mutex
+	entries map[string]kvEntry
+}
+
+func (kv *memKV) Get(key string) (nats.KeyValueEntry, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	e, ok := kv.entries[key]
+	if !ok || e.op != nats.KeyValuePut {
+		return nil, nats.ErrKeyNotFound
+	}
+	return e, nil
+}
+
+func (kv *memKV) Put(key string, value []byte) (uint64, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.set(key, value, nats.KeyValuePut), nil
+}
+
+func (kv *memKV) Create(key string, value []byte) (uint64, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if e, ok := kv.entries[key]; ok && e.op == nats.KeyValuePut {
+		return 0, nats.ErrKeyExists
+	}
+	return kv.set(key, value, nats.KeyValuePut), nil
+}
+
+func (kv *memKV) Update(key string, value []byte, last uint64) (uint64, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.entries[key].rev != last {
+		return 0, nats.ErrKeyExists
+	}
+	return kv.set(key, value, nats.KeyValuePut), nil
+}
+
+func (kv *memKV) Delete(key string, opts ...nats.DeleteOpt) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.set(key, nil, nats.KeyValueDelete)
+	return nil
+}
+
+func (kv *memKV) set(key string, value []byte, op nats.KeyValueOp) uint64 {
+	rev := kv.entries[key].rev + 1
+	kv.entries[key] = kvEntry{key: key, value: value, op: op, rev: rev}
+	return rev
+}
+
+func TestIdempotencyClaim(t *testing.T) {
+	kv := &memKV{entries: make(map[string]kvEntry)}
+	f := &idempotencyFilter{kv: kv, sub: "test", claimTimeout: time.Minute}
+	key := f.msgKey(&nats.Msg{Header: nats.Header{nats.MsgIdHdr: []string{"id-1"}}}, nil)
+	var (
+		wg       sync.WaitGroup
+		acquired atomic.Int32
+	)
+	for range 10 {
+		wg.Go(func() {
+			if res, err := f.claim(key); err == nil && res == claimAcquired {
+				acquired.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	if acquired.Load() != 1 {
+		t.Fatalf("acquired=%d", acquired.Load())
+	}
+	if res, _ := f.claim(key); res != claimBusy {
+		t.Errorf("processing claim=%d", res)
+	}
+	f.release(key)
+	if res, _ := f.claim(key); res != claimAcquired {
+		t.Errorf("released claim=%d", res)
+	}
+	f.markProcessed(key)
+	if res, _ := f.claim(key); res != claimProcessed {
+		t.Errorf("processed claim=%d", res)
+	}
+	kv.Put(key, []byte(claimingPrefix+strconv.FormatInt(time.Now().Add(-2*time.Minute).UnixMilli(), 10)))
+	if res, _ := f.claim(key); res != claimAcquired {
+		t.Errorf("expired claim=%d", res)
+	}
+}
+
+func TestConsumeBatchWithoutMetadata(t *testing.T) {
+	called := false
+	listener := func(ctx context.Context, msgs []*mq.Message) []error {
+		called = true
+		return nil
+	}
+	msgs := []*nats.Msg{{Subject: "test", Data: []byte("a")}, {Subject: "test", Reply: "not-a-js-ack"}}
+	consumeBatch(msgs, ConsumerOptions{ConsumerOptions: mq.ConsumerOptions{Topic: "test"}}, listener)
+	if called {
+		t.Error("messages without metadata should not be delivered")
+	}
+	consume(msgs[0], ConsumerOptions{ConsumerOptions: mq.ConsumerOptions{Topic: "test", MessageListener: func(ctx context.Context, msg *mq.Message) error {
+		called = true
+		return nil
+	}}})
+	if called {
+		t.Error("message without metadata should not be delivered")
+	}
+}
+
+func TestIdempotencyWaitClaim(t *testing.T) {
+	kv := &memKV{entries: make(map[string]kvEntry)}
+	f := &idempotencyFilter{kv: kv, sub: "test", claimTimeout: time.Minute, busyDelay: 10 * time.Millisecond}
+	key := f.msgKey(&nats.Msg{Header: nats.Header{nats.MsgIdHdr: []string{"id-1"}}}, nil)
+	if res, _ := f.claim(key); res != claimAcquired {
+		t.Fatalf("claim=%d", res)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		f.markProcessed(key)
+	}()
+	var progress atomic.Int32
+	res, err := f.waitClaim(key, func(...nats.AckOpt) error {
+		progress.Add(1)
+		return nil
+	})
+	if err != nil || res != claimProcessed {
+		t.Errorf("waitClaim=%d,%v", res, err)
+	}
+	if progress.Load() == 0 {
+		t.Error("in progress should be sent while waiting")
+	}
+}
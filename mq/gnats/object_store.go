@@ -0,0 +1,120 @@
+package gnats
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/skirrund/gcloud/logger"
+)
+
+// ObjectStoreOptions object store bucket 配置，AutoCreate 为 true 时 bucket 不存在则按配置创建
+type ObjectStoreOptions struct {
+	Bucket      string
+	AutoCreate  bool
+	Description string
+	TTL         time.Duration
+	MaxBytes    int64
+	Replicas    int
+	Storage     nats.StorageType
+}
+
+type ObjectStore struct {
+	os nats.ObjectStore
+}
+
+func (nc *natsConn) ObjectStore(opts ObjectStoreOptions) (*ObjectStore, error) {
+	if len(opts.Bucket) == 0 {
+		return nil, errors.New("[nats] object store bucket is empty")
+	}
+	os, err := nc.js.ObjectStore(opts.Bucket)
+	if err != nil && opts.AutoCreate && errors.Is(err, nats.ErrStreamNotFound) {
+		logger.Info("[nats]create object store bucket:", opts.Bucket)
+		os, err = nc.js.CreateObjectStore(&nats.ObjectStoreConfig{
+			Bucket:      opts.Bucket,
+			Description: opts.Description,
+			TTL:         opts.TTL,
+			MaxBytes:    opts.MaxBytes,
+			Replicas:    opts.Replicas,
+			Storage:     opts.Storage,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectStore{os: os}, nil
+}
+
+// Raw 返回底层 nats.ObjectStore
+func (s *ObjectStore) Raw() nats.ObjectStore {
+	return s.os
+}
+
+func (s *ObjectStore) Put(name string, reader io.Reader, headers map[string]string) (*nats.ObjectInfo, error) {
+	meta := &nats.ObjectMeta{Name: name}
+	if len(headers) > 0 {
+		meta.Headers = make(nats.Header)
+		for k, v := range headers {
+			meta.Headers.Set(k, v)
+		}
+	}
+	return s.os.Put(meta, reader)
+}
+
+func (s *ObjectStore) PutBytes(name string, data []byte) (*nats.ObjectInfo, error) {
+	return s.os.PutBytes(name, data)
+}
+
+// Get 调用方需要关闭返回的 nats.ObjectResult，对象不存在时返回 nats.ErrObjectNotFound
+func (s *ObjectStore) Get(name string) (nats.ObjectResult, error) {
+	return s.os.Get(name)
+}
+
+func (s *ObjectStore) GetBytes(name string) ([]byte, error) {
+	return s.os.GetBytes(name)
+}
+
+func (s *ObjectStore) GetInfo(name string) (*nats.ObjectInfo, error) {
+	return s.os.GetInfo(name)
+}
+
+func (s *ObjectStore) Delete(name string) error {
+	return s.os.Delete(name)
+}
+
+// List 不包含已删除的对象
+func (s *ObjectStore) List() ([]*nats.ObjectInfo, error) {
+	list, err := s.os.List()
+	if errors.Is(err, nats.ErrNoObjectsFound) {
+		return nil, nil
+	}
+	return list, err
+}
+
+// Watch 监听对象变更直到 ctx 结束，删除事件 ObjectInfo.Deleted 为 true
+func (s *ObjectStore) Watch(ctx context.Context, fn func(info *nats.ObjectInfo)) error {
+	w, err := s.os.Watch(nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer w.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case info, ok := <-w.Updates():
+				if !ok {
+					return
+				}
+				if info == nil {
+					continue
+				}
+				fn(info)
+			}
+		}
+	}()
+	return nil
+}
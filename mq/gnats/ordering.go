@@ -0,0 +1,221 @@
+package gnats
+
+import (
+	"errors"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/utils"
+	"github.com/skirrund/gcloud/utils/worker"
+)
+
+type ConsumeMode int
+
+const (
+	// ConsumeModeConcurrent 默认模式，消息并发处理，不保证顺序
+	ConsumeModeConcurrent ConsumeMode = iota
+	// ConsumeModeOrdered 单协程逐条处理，严格有序需要 consumer 配置 MaxAckPending=1
+	ConsumeModeOrdered
+	// ConsumeModeKeyOrdered 按 key 哈希到固定的处理通道，相同 key 的消息有序
+	ConsumeModeKeyOrdered
+)
+
+// DefaultOrderKeyHeader ConsumeModeKeyOrdered 默认从该 header 读取 key
+const DefaultOrderKeyHeader = "Order-Key"
+
+// PartitionOptions 分区消费，topic.<n> 为第 n 个分区，每个分区对应名为 <SubscriptionName>-<n> 的 consumer 并按顺序消费
+type PartitionOptions struct {
+	Partitions int
+	// Assigned 当前实例消费的分区，为空时按 PodIndex/PodCount 取模分配
+	Assigned []int
+	PodIndex int
+	PodCount int
+}
+
+func (p *PartitionOptions) assigned() ([]int, error) {
+	if p.Partitions <= 0 {
+		return nil, errors.New("[nats] partitions must be greater than 0")
+	}
+	if len(p.Assigned) > 0 {
+		for _, n := range p.Assigned {
+			if n < 0 || n >= p.Partitions {
+				return nil, errors.New("[nats] assigned partition out of range:" + strconv.Itoa(n))
+			}
+		}
+		return p.Assigned, nil
+	}
+	count := max(p.PodCount, 1)
+	if p.PodIndex < 0 || p.PodIndex >= count {
+		return nil, errors.New("[nats] invalid pod index:" + strconv.Itoa(p.PodIndex))
+	}
+	var list []int
+	for n := range p.Partitions {
+		if n%count == p.PodIndex {
+			list = append(list, n)
+		}
+	}
+	return list, nil
+}
+
+// Partition 按 key 计算分区
+func Partition(key string, partitions int) int {
+	if partitions <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// PartitionSubject 返回 key 对应的分区 subject，发送时需要同时指定 NatsOpts.Stream
+func PartitionSubject(topic, key string, partitions int) string {
+	return strings.ReplaceAll(topic, "/", "-") + "." + strconv.Itoa(Partition(key, partitions))
+}
+
+// PodIndexFromHostname 从 StatefulSet 的 hostname(xxx-<n>) 中解析实例序号，解析失败返回 -1
+func PodIndexFromHostname() int {
+	host, err := os.Hostname()
+	if err != nil {
+		return -1
+	}
+	idx := strings.LastIndex(host, "-")
+	if idx < 0 {
+		return -1
+	}
+	n, err := strconv.Atoi(host[idx+1:])
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+func (nc *natsConn) partitionSubscribe(opts ConsumerOptions) error {
+	assigned, err := opts.Partition.assigned()
+	if err != nil {
+		doPanic(opts.IsErrorPanic, err)
+		return err
+	}
+	subject := strings.ReplaceAll(opts.Topic, "/", "-")
+	if len(opts.NatsOpts.Stream) == 0 {
+		opts.NatsOpts.Stream = subject
+	}
+	if opts.Mode == ConsumeModeConcurrent {
+		opts.Mode = ConsumeModeOrdered
+	}
+	logger.Info("[nats]partition subscribe:", subject, ",assigned:", assigned)
+	// 正常订阅时 doSubscribe 会一直阻塞，任一分区出错时立即返回
+	errCh := make(chan error, len(assigned))
+	for _, n := range assigned {
+		po := opts
+		po.Partition = nil
+		po.Topic = subject + "." + strconv.Itoa(n)
+		po.SubscriptionName = opts.SubscriptionName + "-" + strconv.Itoa(n)
+		go func() {
+			err := nc.doSubscribe(po)
+			if err != nil {
+				logger.Error("[nats]partition subscribe error:", po.Topic, "=>", po.SubscriptionName, ",", err.Error())
+			}
+			errCh <- err
+		}()
+	}
+	for range assigned {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type dispatcher func(msg *nats.Msg)
+
+func newDispatcher(opts ConsumerOptions, push bool) dispatcher {
+	if opts.Batch != nil {
+		return newBatchDispatcher(opts)
+	}
+	switch opts.Mode {
+	case ConsumeModeOrdered:
+		return func(msg *nats.Msg) {
+			consume(msg, opts)
+		}
+	case ConsumeModeKeyOrdered:
+		lanes := opts.Lanes
+		if lanes <= 0 {
+			lanes = opts.NatsOpts.PullBatchSize
+		}
+		chans := make([]chan *nats.Msg, lanes)
+		for i := range chans {
+			ch := make(chan *nats.Msg, opts.MaxMessageChannelSize/lanes+1)
+			chans[i] = ch
+			go func() {
+				for msg := range ch {
+					consume(msg, opts)
+				}
+			}()
+		}
+		return func(msg *nats.Msg) {
+			chans[Partition(orderKey(msg, opts), lanes)] <- msg
+		}
+	default:
+		if push {
+			return func(msg *nats.Msg) {
+				go consume(msg, opts)
+			}
+		}
+		execWorker := worker.Init(opts.NatsOpts.PullBatchSize * 2)
+		return func(msg *nats.Msg) {
+			execWorker.Execute(func() {
+				consume(msg, opts)
+			})
+		}
+	}
+}
+
+// orderKey 依次从 OrderKeyHeader、payload 中的 OrderKeyField 字段读取，都不存在时使用 subject
+func orderKey(msg *nats.Msg, opts ConsumerOptions) string {
+	header := opts.OrderKeyHeader
+	if len(header) == 0 {
+		header = DefaultOrderKeyHeader
+	}
+	if key := msg.Header.Get(header); len(key) > 0 {
+		return key
+	}
+	if len(opts.OrderKeyField) > 0 {
+		if key, ok := payloadField(msg.Data, opts.OrderKeyField); ok {
+			return key
+		}
+	}
+	return msg.Subject
+}
+
+// payloadField 读取 json payload 中的字段，path 以 . 分隔
+func payloadField(data []byte, path string) (string, bool) {
+	var v any
+	if err := utils.Unmarshal(data, &v); err != nil {
+		return "", false
+	}
+	for _, p := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[p]; !ok {
+			return "", false
+		}
+	}
+	switch val := v.(type) {
+	case string:
+		return val, true
+	case nil:
+		return "", false
+	default:
+		b, err := utils.Marshal(val)
+		if err != nil {
+			return "", false
+		}
+		return string(b), true
+	}
+}
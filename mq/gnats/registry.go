@@ -0,0 +1,95 @@
+package gnats
+
+import (
+	"errors"
+	"sync"
+)
+
+const DefaultConnectionName = "default"
+
+var (
+	connections = make(map[string]*natsConn)
+	connMu      sync.Mutex
+)
+
+// Register 按名称创建并注册连接，同名连接已存在时返回已有连接，Option 不同时返回错误
+func Register(name string, opt Option) (Client, error) {
+	if len(name) == 0 {
+		return nil, errors.New("[nats] connection name is empty")
+	}
+	connMu.Lock()
+	c, err := registered(name, opt)
+	connMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		return c, nil
+	}
+	// 在锁外建立连接，避免一个不可达的服务阻塞其他连接的 Get/Register/Close
+	nc, err := newConnection(name, opt)
+	if err != nil {
+		return nil, err
+	}
+	connMu.Lock()
+	defer connMu.Unlock()
+	// 并发注册时使用先注册的连接，关闭本次建立的连接
+	if c, err = registered(name, opt); err != nil || c != nil {
+		nc.conn.Close()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	connections[name] = nc
+	return nc, nil
+}
+
+// registered 需要持有 connMu
+func registered(name string, opt Option) (*natsConn, error) {
+	c, ok := connections[name]
+	if !ok {
+		return nil, nil
+	}
+	if c.opt != opt {
+		return nil, errors.New("[nats] connection " + name + " is already registered with different options")
+	}
+	return c, nil
+}
+
+// Get 获取已注册的连接
+func Get(name string) (Client, bool) {
+	connMu.Lock()
+	defer connMu.Unlock()
+	c, ok := connections[name]
+	if !ok {
+		return nil, false
+	}
+	return c, true
+}
+
+// Default 获取 NewDefaultConnection 创建的连接
+func Default() (Client, bool) {
+	return Get(DefaultConnectionName)
+}
+
+// CloseAll 关闭所有已注册的连接
+func CloseAll() {
+	connMu.Lock()
+	list := make([]*natsConn, 0, len(connections))
+	for _, c := range connections {
+		list = append(list, c)
+	}
+	connMu.Unlock()
+	for _, c := range list {
+		c.Close()
+	}
+}
+
+func unregister(nc *natsConn) {
+	connMu.Lock()
+	defer connMu.Unlock()
+	if c, ok := connections[nc.name]; ok && c == nc {
+		delete(connections, nc.name)
+	}
+}
@@ -0,0 +1,201 @@
+package gnats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/tracer"
+	"github.com/skirrund/gcloud/utils"
+	"github.com/skirrund/gcloud/utils/worker"
+)
+
+const (
+	RpcErrorCodeHeader    = "Gcloud-Rpc-Error-Code"
+	RpcErrorMsgHeader     = "Gcloud-Rpc-Error-Msg"
+	DefaultRequestTimeout = 5 * time.Second
+	DefaultServeWorkers   = 256
+	RpcBadRequestCode     = 400
+	RpcInternalErrorCode  = 500
+	RpcNoRespondersCode   = 503
+	RpcTimeoutCode        = 504
+)
+
+var headerValueReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// RpcError request/reply 的结构化错误，服务端返回后通过 header 传回调用方
+type RpcError struct {
+	Code    int
+	Message string
+}
+
+func (e *RpcError) Error() string {
+	return "[nats-rpc]code:" + strconv.Itoa(e.Code) + ",msg:" + e.Message
+}
+
+func NewRpcError(code int, message string) *RpcError {
+	return &RpcError{Code: code, Message: message}
+}
+
+// RpcHandler 处理请求，返回值为 []byte 时原样返回，否则 json 序列化
+type RpcHandler func(ctx context.Context, msg *nats.Msg) (any, error)
+
+// TypedHandler 将强类型处理函数包装为 RpcHandler，请求体按 json 反序列化到 Req
+func TypedHandler[Req any, Resp any](fn func(ctx context.Context, req *Req) (Resp, error)) RpcHandler {
+	return func(ctx context.Context, msg *nats.Msg) (any, error) {
+		req := new(Req)
+		if len(msg.Data) > 0 {
+			if err := decodeData(msg.Data, req); err != nil {
+				return nil, NewRpcError(RpcBadRequestCode, "bad request:"+err.Error())
+			}
+		}
+		return fn(ctx, req)
+	}
+}
+
+func getTraceId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if id, ok := ctx.Value(tracer.TraceIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+func encodeData(v any) ([]byte, error) {
+	switch d := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return d, nil
+	case string:
+		return []byte(d), nil
+	default:
+		return utils.Marshal(v)
+	}
+}
+
+func decodeData(data []byte, v any) error {
+	switch d := v.(type) {
+	case *[]byte:
+		*d = data
+		return nil
+	case *string:
+		*d = string(data)
+		return nil
+	default:
+		return utils.Unmarshal(data, v)
+	}
+}
+
+// Request 发送请求并等待响应，ctx 未设置 deadline 时使用 Option.RequestTimeout；resp 为 *[]byte 时返回原始数据
+func (nc *natsConn) Request(ctx context.Context, subject string, req any, resp any) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, nc.requestTimeout)
+		defer cancel()
+	}
+	data, err := encodeData(req)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	if traceId := getTraceId(ctx); len(traceId) > 0 {
+		msg.Header.Set(tracer.TraceIDKey, traceId)
+	}
+	reply, err := nc.conn.RequestMsgWithContext(ctx, msg)
+	if err != nil {
+		if errors.Is(err, nats.ErrNoResponders) {
+			return NewRpcError(RpcNoRespondersCode, err.Error())
+		}
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+			return NewRpcError(RpcTimeoutCode, err.Error())
+		}
+		return err
+	}
+	if code := reply.Header.Get(RpcErrorCodeHeader); len(code) > 0 {
+		c, _ := strconv.Atoi(code)
+		return NewRpcError(c, reply.Header.Get(RpcErrorMsgHeader))
+	}
+	if resp == nil || len(reply.Data) == 0 {
+		return nil
+	}
+	return decodeData(reply.Data, resp)
+}
+
+// Serve 订阅 subject 处理请求，queueGroup 非空时以队列组方式负载均衡
+func (nc *natsConn) Serve(subject, queueGroup string, handler RpcHandler) (*nats.Subscription, error) {
+	execWorker := worker.Init(DefaultServeWorkers)
+	cb := func(msg *nats.Msg) {
+		execWorker.Execute(func() {
+			serveMsg(msg, handler)
+		})
+	}
+	logger.Info("[nats-rpc]serve:", subject, ",queueGroup:", queueGroup)
+	if len(queueGroup) > 0 {
+		return nc.conn.QueueSubscribe(subject, queueGroup, cb)
+	}
+	return nc.conn.Subscribe(subject, cb)
+}
+
+func serveMsg(msg *nats.Msg, handler RpcHandler) {
+	var logCtx context.Context
+	if traceId := msg.Header.Get(tracer.TraceIDKey); len(traceId) > 0 {
+		logCtx = tracer.NewContextFromTraceId(traceId)
+	} else {
+		logCtx = tracer.NewTraceIDContext()
+	}
+	reply := handleMsg(logCtx, msg, handler)
+	if reply == nil {
+		return
+	}
+	if e := msg.RespondMsg(reply); e != nil {
+		logger.ErrorContext(logCtx, "[nats-rpc] respond error:", e.Error())
+	}
+}
+
+// handleMsg 调用 handler 并生成响应，错误通过 header 返回；msg 没有 Reply 时返回 nil
+func handleMsg(logCtx context.Context, msg *nats.Msg, handler RpcHandler) *nats.Msg {
+	var (
+		resp any
+		err  error
+	)
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				logger.ErrorContext(logCtx, "[nats-rpc] handler panic recover :", e, "\n", string(debug.Stack()))
+				err = NewRpcError(RpcInternalErrorCode, fmt.Sprint(e))
+			}
+		}()
+		resp, err = handler(logCtx, msg)
+	}()
+	if len(msg.Reply) == 0 {
+		return nil
+	}
+	reply := nats.NewMsg(msg.Reply)
+	if err == nil {
+		reply.Data, err = encodeData(resp)
+	}
+	if err != nil {
+		logger.ErrorContext(logCtx, "[nats-rpc] handler error:", msg.Subject, ",", err.Error())
+		var rpcErr *RpcError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = NewRpcError(RpcInternalErrorCode, err.Error())
+		}
+		reply.Data = nil
+		reply.Header.Set(RpcErrorCodeHeader, strconv.Itoa(rpcErr.Code))
+		reply.Header.Set(RpcErrorMsgHeader, headerValueReplacer.Replace(rpcErr.Message))
+	}
+	return reply
+}
@@ -0,0 +1,175 @@
+package gnats
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/mq"
+)
+
+const (
+	ScheduleEvery = "@every "
+)
+
+var predefinedSchedules = map[string]struct{}{
+	"@yearly":   {},
+	"@annually": {},
+	"@monthly":  {},
+	"@weekly":   {},
+	"@daily":    {},
+	"@midnight": {},
+	"@hourly":   {},
+}
+
+// Schedule 已发送的定时消息，可用于取消或替换
+type Schedule struct {
+	Stream string
+	// Subject 定时消息所在的 <stream>.schedules.<name>
+	Subject string
+	// Target 到期后投递的 subject
+	Target   string
+	Spec     string
+	Sequence uint64
+	Time     time.Time
+	Payload  []byte
+}
+
+// Name 返回 schedule subject 的最后一段
+func (s *Schedule) Name() string {
+	return strings.TrimPrefix(s.Subject, s.Stream+ScheduleSubjectSubfix)
+}
+
+// ScheduleOptions Spec 为空时使用 mq.Message 的 DeliverAt/DeliverAfter；Name 为空时随机生成，相同 Name 的定时消息会被替换
+type ScheduleOptions struct {
+	Spec string
+	Name string
+}
+
+func ScheduleAtSpec(t time.Time) string {
+	return ScheduleAt + t.Format(time.RFC3339)
+}
+
+func ScheduleEverySpec(d time.Duration) string {
+	return ScheduleEvery + d.String()
+}
+
+// ValidateScheduleSpec 支持 @at <RFC3339>、@every <duration>、@hourly 等预定义值以及 6 段(秒 分 时 日 月 周) cron 表达式
+func ValidateScheduleSpec(spec string) error {
+	spec = strings.TrimSpace(spec)
+	switch {
+	case len(spec) == 0:
+		return errors.New("[nats] schedule is empty")
+	case strings.HasPrefix(spec, ScheduleAt):
+		if _, err := time.Parse(time.RFC3339, strings.TrimPrefix(spec, ScheduleAt)); err != nil {
+			return errors.New("[nats] invalid @at schedule:" + err.Error())
+		}
+	case strings.HasPrefix(spec, ScheduleEvery):
+		d, err := time.ParseDuration(strings.TrimPrefix(spec, ScheduleEvery))
+		if err != nil {
+			return errors.New("[nats] invalid @every schedule:" + err.Error())
+		}
+		if d < time.Second {
+			return errors.New("[nats] @every schedule must be at least 1s")
+		}
+	case strings.HasPrefix(spec, "@"):
+		if _, ok := predefinedSchedules[spec]; !ok {
+			return errors.New("[nats] unknown schedule:" + spec)
+		}
+	default:
+		if len(strings.Fields(spec)) != 6 {
+			return errors.New("[nats] cron schedule must have 6 fields:" + spec)
+		}
+		for _, c := range spec {
+			if !strings.ContainsRune("0123456789*,-/? ", c) && !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') {
+				return errors.New("[nats] invalid cron schedule:" + spec)
+			}
+		}
+	}
+	return nil
+}
+
+// SendSchedule 发送定时消息并返回 Schedule
+func (nc *natsConn) SendSchedule(msg *mq.Message, opts ScheduleOptions) (*Schedule, error) {
+	spec := opts.Spec
+	if len(spec) == 0 {
+		spec = getSchedule(msg.DeliverAt, msg.DeliverAfter)
+	}
+	if err := ValidateScheduleSpec(spec); err != nil {
+		return nil, err
+	}
+	nm, pubOpts := buildMsg(msg, spec, opts.Name)
+	ack, err := nc.js.PublishMsg(nm, pubOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Schedule{
+		Stream:   ack.Stream,
+		Subject:  nm.Subject,
+		Target:   nm.Header.Get(NatsScheduleTarget),
+		Spec:     spec,
+		Sequence: ack.Sequence,
+		Time:     time.Now(),
+		Payload:  nm.Data,
+	}, nil
+}
+
+// CancelSchedule 取消尚未投递的定时消息
+func (nc *natsConn) CancelSchedule(s *Schedule) error {
+	if s == nil || len(s.Stream) == 0 || len(s.Subject) == 0 {
+		return errors.New("[nats] invalid schedule")
+	}
+	logger.Info("[nats]cancel schedule:", s.Stream, ",", s.Subject)
+	return nc.js.PurgeStream(s.Stream, &nats.StreamPurgeRequest{Subject: s.Subject})
+}
+
+// ReplaceSchedule 用新的消息和 schedule 替换原定时消息，opts.Name 会被忽略
+func (nc *natsConn) ReplaceSchedule(s *Schedule, msg *mq.Message, opts ScheduleOptions) (*Schedule, error) {
+	if s == nil || len(s.Stream) == 0 || len(s.Subject) == 0 {
+		return nil, errors.New("[nats] invalid schedule")
+	}
+	if len(msg.NatsOpts.Stream) == 0 {
+		msg.NatsOpts.Stream = s.Stream
+	}
+	opts.Name = s.Name()
+	ns, err := nc.SendSchedule(msg, opts)
+	if err != nil {
+		return nil, err
+	}
+	// 只保留最新的一条
+	if err := nc.js.PurgeStream(ns.Stream, &nats.StreamPurgeRequest{Subject: ns.Subject, Keep: 1}); err != nil {
+		logger.Error("[nats]purge replaced schedule error:", ns.Subject, ",", err.Error())
+		return ns, err
+	}
+	return ns, nil
+}
+
+// ListSchedules 列出 stream 中尚未投递的定时消息
+func (nc *natsConn) ListSchedules(stream string) ([]*Schedule, error) {
+	info, err := nc.js.StreamInfo(stream, &nats.StreamInfoRequest{SubjectsFilter: stream + ScheduleSubjectSubfix + ">"})
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Schedule, 0, len(info.State.Subjects))
+	for subject := range info.State.Subjects {
+		m, err := nc.js.GetLastMsg(stream, subject)
+		if err != nil {
+			if errors.Is(err, nats.ErrMsgNotFound) {
+				continue
+			}
+			return list, err
+		}
+		list = append(list, &Schedule{
+			Stream:   stream,
+			Subject:  m.Subject,
+			Target:   m.Header.Get(NatsScheduleTarget),
+			Spec:     m.Header.Get(NatsSchedule),
+			Sequence: m.Sequence,
+			Time:     m.Time,
+			Payload:  m.Data,
+		})
+	}
+	return list, nil
+}
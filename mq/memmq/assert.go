@@ -0,0 +1,51 @@
+package memmq
+
+import (
+	"context"
+	"time"
+)
+
+// TestingT *testing.T 满足该接口，非测试代码引用 memmq 时不引入 testing
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...any)
+	Fatalf(format string, args ...any)
+}
+
+// DefaultAssertTimeout 断言前等待消息处理完成的最长时间
+const DefaultAssertTimeout = 5 * time.Second
+
+// AssertSent 断言发送到 topic 的消息数
+func (b *Broker) AssertSent(t TestingT, topic string, n int) {
+	t.Helper()
+	if got := len(b.Sent(topic)); got != n {
+		t.Errorf("[memmq] topic %s sent %d messages, want %d", topic, got, n)
+	}
+}
+
+// AssertAcked 等待消息处理完成后断言处理成功的消息数
+func (b *Broker) AssertAcked(t TestingT, topic string, n int) {
+	t.Helper()
+	b.waitIdle(t)
+	if got := len(b.Acked(topic)); got != n {
+		t.Errorf("[memmq] topic %s acked %d messages, want %d", topic, got, n)
+	}
+}
+
+// AssertDeadLettered 等待消息处理完成后断言不再重试的消息数
+func (b *Broker) AssertDeadLettered(t TestingT, topic string, n int) {
+	t.Helper()
+	b.waitIdle(t)
+	if got := len(b.DeadLettered(topic)); got != n {
+		t.Errorf("[memmq] topic %s dead lettered %d messages, want %d", topic, got, n)
+	}
+}
+
+func (b *Broker) waitIdle(t TestingT) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultAssertTimeout)
+	defer cancel()
+	if !b.WaitIdle(ctx) {
+		t.Fatalf("[memmq] messages still in flight after %s", DefaultAssertTimeout)
+	}
+}
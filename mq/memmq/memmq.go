@@ -0,0 +1,262 @@
+// Package memmq 内存实现的 mq.IClient，用于单元测试，不依赖 nats 或 pulsar
+package memmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/mq"
+	"github.com/skirrund/gcloud/tracer"
+)
+
+const (
+	MAX_RETRY_TIMES = 50
+	// DefaultRetryDelay ACK_MANUAL 失败后重新投递的延迟
+	DefaultRetryDelay = 10 * time.Millisecond
+)
+
+var ErrClosed = errors.New("[memmq] broker is closed")
+
+// Broker 同一 topic 的不同 SubscriptionName 各自收到全部消息，相同 SubscriptionName 的订阅轮流消费；
+// 只投递给发送时已存在的订阅，RedeliveryCount 从 0 开始
+type Broker struct {
+	// RetryDelay 为0时使用 DefaultRetryDelay
+	RetryDelay time.Duration
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	groups   map[string]map[string]*group
+	sent     []*mq.Message
+	acked    []*mq.Message
+	dead     []*mq.Message
+	pending  int
+	closed   bool
+	closedCh chan struct{}
+}
+
+type group struct {
+	subs []mq.ConsumerOptions
+	next int
+}
+
+var _ mq.IClient = (*Broker)(nil)
+
+func New() *Broker {
+	b := &Broker{
+		groups:   make(map[string]map[string]*group),
+		closedCh: make(chan struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *Broker) Send(msg *mq.Message) error {
+	if len(msg.Topic) == 0 {
+		return errors.New("[memmq] topic is empty")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	b.sent = append(b.sent, copyMsg(msg))
+	var delay time.Duration
+	if !msg.DeliverAt.IsZero() {
+		delay = time.Until(msg.DeliverAt)
+	} else if msg.DeliverAfter > 0 {
+		delay = msg.DeliverAfter
+	}
+	for _, g := range b.groups[msg.Topic] {
+		opts := g.subs[g.next%len(g.subs)]
+		g.next++
+		b.schedule(opts, copyMsg(msg), delay)
+	}
+	return nil
+}
+
+// SendAsync 与 Send 相同，消息总是异步投递
+func (b *Broker) SendAsync(msg *mq.Message) error {
+	return b.Send(msg)
+}
+
+func (b *Broker) Subscribe(opts mq.ConsumerOptions) error {
+	if len(opts.Topic) == 0 {
+		return errors.New("[memmq] topic is empty")
+	}
+	if opts.MessageListener == nil {
+		return errors.New("[memmq] MessageListener is nil")
+	}
+	if opts.RetryTimes == 0 {
+		opts.RetryTimes = MAX_RETRY_TIMES
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	topicGroups, ok := b.groups[opts.Topic]
+	if !ok {
+		topicGroups = make(map[string]*group)
+		b.groups[opts.Topic] = topicGroups
+	}
+	g, ok := topicGroups[opts.SubscriptionName]
+	if !ok {
+		g = &group{}
+		topicGroups[opts.SubscriptionName] = g
+	}
+	g.subs = append(g.subs, opts)
+	return nil
+}
+
+// SubscribeSync 订阅后阻塞直到 Close
+func (b *Broker) SubscribeSync(opts mq.ConsumerOptions) error {
+	if err := b.Subscribe(opts); err != nil {
+		return err
+	}
+	<-b.closedCh
+	return nil
+}
+
+// Close 等待已投递的消息处理完成，未到期的延迟消息不再投递
+func (b *Broker) Close() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.closedCh)
+	for b.pending > 0 {
+		b.cond.Wait()
+	}
+	b.mu.Unlock()
+}
+
+// schedule 需要持有 b.mu
+func (b *Broker) schedule(opts mq.ConsumerOptions, msg *mq.Message, delay time.Duration) {
+	b.pending++
+	go func() {
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-b.closedCh:
+				timer.Stop()
+				b.done()
+				return
+			}
+		}
+		b.deliver(opts, msg)
+	}()
+}
+
+func (b *Broker) done() {
+	b.mu.Lock()
+	b.pending--
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+func (b *Broker) deliver(opts mq.ConsumerOptions, msg *mq.Message) {
+	defer b.done()
+	msg.SubOpts = mq.SubOpts{Name: opts.SubscriptionName}
+	err := consume(opts, copyMsg(msg))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.acked = append(b.acked, msg)
+		return
+	}
+	if opts.ACKMode == mq.ACK_MANUAL && msg.RedeliveryCount < min(opts.RetryTimes, MAX_RETRY_TIMES) && !b.closed {
+		retry := copyMsg(msg)
+		retry.RedeliveryCount++
+		delay := b.RetryDelay
+		if delay <= 0 {
+			delay = DefaultRetryDelay
+		}
+		b.schedule(opts, retry, delay)
+		return
+	}
+	b.dead = append(b.dead, msg)
+}
+
+func consume(opts mq.ConsumerOptions, msg *mq.Message) (err error) {
+	logCtx := tracer.NewTraceIDContext()
+	defer func() {
+		if e := recover(); e != nil {
+			logger.ErrorContext(logCtx, "[memmq] consumer panic recover :", e, "\n", string(debug.Stack()))
+			err = errors.New(fmt.Sprint("[memmq] consumer panic:", e))
+		}
+	}()
+	return opts.MessageListener(logCtx, msg)
+}
+
+func copyMsg(msg *mq.Message) *mq.Message {
+	m := *msg
+	m.Payload = append([]byte(nil), msg.Payload...)
+	m.Header = maps.Clone(msg.Header)
+	return &m
+}
+
+// WaitIdle 等待所有已投递和延迟中的消息处理完成，超时返回 false
+func (b *Broker) WaitIdle(ctx context.Context) bool {
+	stop := context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	})
+	defer stop()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.pending > 0 {
+		if ctx.Err() != nil {
+			return false
+		}
+		b.cond.Wait()
+	}
+	return true
+}
+
+// Sent 发送到 topic 的消息，topic 为空时返回全部
+func (b *Broker) Sent(topic string) []*mq.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return filter(b.sent, topic)
+}
+
+// Acked 处理成功的消息，每个订阅各记录一次
+func (b *Broker) Acked(topic string) []*mq.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return filter(b.acked, topic)
+}
+
+// DeadLettered 处理失败且不再重试的消息
+func (b *Broker) DeadLettered(topic string) []*mq.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return filter(b.dead, topic)
+}
+
+// Reset 清空记录的消息，保留订阅
+func (b *Broker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent, b.acked, b.dead = nil, nil, nil
+}
+
+func filter(msgs []*mq.Message, topic string) []*mq.Message {
+	var res []*mq.Message
+	for _, m := range msgs {
+		if len(topic) == 0 || m.Topic == topic {
+			res = append(res, m)
+		}
+	}
+	return res
+}
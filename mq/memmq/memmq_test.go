@@ -0,0 +1,48 @@
+package memmq
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skirrund/gcloud/mq"
+)
+
+func TestBroker(t *testing.T) {
+	b := New()
+	defer b.Close()
+	var calls atomic.Int32
+	err := b.Subscribe(mq.ConsumerOptions{
+		Topic:            "orders",
+		SubscriptionName: "orders-sub",
+		ACKMode:          mq.ACK_MANUAL,
+		RetryTimes:       2,
+		MessageListener: func(ctx context.Context, msg *mq.Message) error {
+			calls.Add(1)
+			if string(msg.Payload) == "bad" {
+				return errors.New("bad payload")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	b.Send(&mq.Message{Topic: "orders", Payload: []byte("ok"), DeliverAfter: 50 * time.Millisecond})
+	b.Send(&mq.Message{Topic: "orders", Payload: []byte("bad")})
+	b.AssertSent(t, "orders", 2)
+	b.AssertAcked(t, "orders", 1)
+	b.AssertDeadLettered(t, "orders", 1)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("delayed message delivered too early")
+	}
+	if dead := b.DeadLettered("orders"); dead[0].RedeliveryCount != 2 {
+		t.Errorf("redeliveryCount=%d", dead[0].RedeliveryCount)
+	}
+	if n := calls.Load(); n != 4 {
+		t.Errorf("calls=%d", n)
+	}
+}
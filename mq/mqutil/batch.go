@@ -0,0 +1,116 @@
+package mqutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/skirrund/gcloud/mq"
+)
+
+const (
+	DefaultBatchMaxSize = 100
+	DefaultBatchMaxWait = time.Second
+)
+
+// BatchListener 批量处理消息，返回的 error 与 msgs 按下标一一对应，nil 表示处理成功；
+// 返回的切片为 nil 表示全部成功，长度不足的部分视为成功
+type BatchListener func(ctx context.Context, msgs []*mq.Message) []error
+
+// BatchOptions 累计到 MaxSize 条或距第一条消息超过 MaxWait 时调用一次 Listener
+type BatchOptions struct {
+	Listener BatchListener
+	MaxSize  int
+	MaxWait  time.Duration
+}
+
+func (o *BatchOptions) WithDefaults() BatchOptions {
+	opts := *o
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultBatchMaxSize
+	}
+	if opts.MaxWait <= 0 {
+		opts.MaxWait = DefaultBatchMaxWait
+	}
+	return opts
+}
+
+// BatchResult 取第 i 条消息的处理结果
+func BatchResult(errs []error, i int) error {
+	if i < len(errs) {
+		return errs[i]
+	}
+	return nil
+}
+
+// Batcher 按数量或时间聚合元素，flush 在 Add 所在协程(数量触发)或定时器协程(时间触发)中执行
+type Batcher[T any] struct {
+	mu      sync.Mutex
+	items   []T
+	gen     uint64
+	timer   *time.Timer
+	maxSize int
+	maxWait time.Duration
+	flush   func(items []T)
+}
+
+func NewBatcher[T any](maxSize int, maxWait time.Duration, flush func(items []T)) *Batcher[T] {
+	return &Batcher[T]{
+		maxSize: max(maxSize, 1),
+		maxWait: maxWait,
+		flush:   flush,
+	}
+}
+
+func (b *Batcher[T]) Add(item T) {
+	b.mu.Lock()
+	b.items = append(b.items, item)
+	if len(b.items) < b.maxSize {
+		if len(b.items) == 1 && b.maxWait > 0 {
+			gen := b.gen
+			b.timer = time.AfterFunc(b.maxWait, func() {
+				b.flushGen(gen)
+			})
+		}
+		b.mu.Unlock()
+		return
+	}
+	items := b.take()
+	b.mu.Unlock()
+	b.flush(items)
+}
+
+// Flush 立即处理已聚合的元素
+func (b *Batcher[T]) Flush() {
+	b.mu.Lock()
+	items := b.take()
+	b.mu.Unlock()
+	if len(items) > 0 {
+		b.flush(items)
+	}
+}
+
+func (b *Batcher[T]) flushGen(gen uint64) {
+	b.mu.Lock()
+	if gen != b.gen {
+		b.mu.Unlock()
+		return
+	}
+	items := b.take()
+	b.mu.Unlock()
+	if len(items) > 0 {
+		b.flush(items)
+	}
+}
+
+// take 需要持有锁
+func (b *Batcher[T]) take() []T {
+	items := b.items
+	b.items = nil
+	b.gen++
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return items
+}
@@ -0,0 +1,129 @@
+package mqutil
+
+import (
+	"math/rand/v2"
+	"strconv"
+	"strings"
+
+	"github.com/skirrund/gcloud/bootstrap/env"
+	"github.com/skirrund/gcloud/utils"
+)
+
+type LogLevel int
+
+const (
+	// LogLevelInfo 每条消息都以 Info 输出 payload
+	LogLevelInfo LogLevel = iota
+	// LogLevelError 仅在处理失败时输出 payload
+	LogLevelError
+	// LogLevelNone 不输出 payload
+	LogLevelNone
+)
+
+const MaskValue = "******"
+
+// LogOptions 消息 payload 的日志配置，nats 和 pulsar 共用
+type LogOptions struct {
+	Level LogLevel `property:"mq.log.level"`
+	// MaxPayloadLength 大于0时截断超长的 payload
+	MaxPayloadLength int `property:"mq.log.maxPayloadLength"`
+	// SampleRate (0,1) 之间时按比例采样输出 Info 日志，失败日志不采样
+	SampleRate float64 `property:"mq.log.sampleRate"`
+	// MaskFields 需要脱敏的 json 字段路径，逗号分隔，路径以 . 分隔，* 匹配任意字段，如 user.phone,*.idCard
+	MaskFields string `property:"mq.log.maskFields"`
+	// Redact 自定义脱敏，在 MaskFields 之前执行
+	Redact func(payload []byte) []byte
+}
+
+// DefaultLogOptions 订阅未指定 LogOptions 时以及发送消息时使用
+var DefaultLogOptions = &LogOptions{}
+
+// LoadLogOptions 从配置中读取 mq.log.* 并设置为 DefaultLogOptions
+func LoadLogOptions() *LogOptions {
+	opts := &LogOptions{}
+	utils.NewOptions(env.GetInstance(), opts)
+	DefaultLogOptions = opts
+	return opts
+}
+
+func OrDefault(opts *LogOptions) *LogOptions {
+	if opts == nil {
+		return DefaultLogOptions
+	}
+	return opts
+}
+
+// Sampled 本条消息是否输出 Info 日志
+func (o *LogOptions) Sampled() bool {
+	if o.Level != LogLevelInfo {
+		return false
+	}
+	if o.SampleRate <= 0 || o.SampleRate >= 1 {
+		return true
+	}
+	return rand.Float64() < o.SampleRate
+}
+
+// LogOnError 处理失败时是否需要补充输出 payload
+func (o *LogOptions) LogOnError() bool {
+	return o.Level == LogLevelError
+}
+
+// Format 依次执行 Redact、MaskFields 和截断
+func (o *LogOptions) Format(payload []byte) string {
+	if o.Redact != nil {
+		payload = o.Redact(payload)
+	}
+	if len(o.MaskFields) > 0 {
+		payload = maskFields(payload, o.MaskFields)
+	}
+	if o.MaxPayloadLength > 0 && len(payload) > o.MaxPayloadLength {
+		return string(payload[:o.MaxPayloadLength]) + "...(" + strconv.Itoa(len(payload)) + " bytes)"
+	}
+	return string(payload)
+}
+
+func maskFields(payload []byte, fields string) []byte {
+	var v any
+	if err := utils.Unmarshal(payload, &v); err != nil {
+		return payload
+	}
+	for _, f := range strings.Split(fields, ",") {
+		f = strings.TrimSpace(f)
+		if len(f) > 0 {
+			v = maskPath(v, strings.Split(f, "."))
+		}
+	}
+	b, err := utils.Marshal(v)
+	if err != nil {
+		return payload
+	}
+	return b
+}
+
+func maskPath(v any, path []string) any {
+	switch val := v.(type) {
+	case []any:
+		for i := range val {
+			val[i] = maskPath(val[i], path)
+		}
+		return val
+	case map[string]any:
+		key := path[0]
+		for k, child := range val {
+			if key != "*" && key != k {
+				continue
+			}
+			if len(path) == 1 {
+				if child != nil {
+					val[k] = MaskValue
+				}
+			} else {
+				val[k] = maskPath(child, path[1:])
+			}
+		}
+		return val
+	default:
+		return v
+	}
+}
@@ -0,0 +1,115 @@
+package mqutil
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/skirrund/gcloud-plugins/metrics"
+)
+
+const (
+	SystemNats   = "nats"
+	SystemPulsar = "pulsar"
+	ResultOk     = "ok"
+	ResultError  = "error"
+)
+
+// MQMetrics 消息收发指标，按 system(nats/pulsar)、topic、subscription 区分
+type MQMetrics struct {
+	received        *prometheus.CounterVec
+	acked           *prometheus.CounterVec
+	nacked          *prometheus.CounterVec
+	deadLettered    *prometheus.CounterVec
+	handleDuration  *prometheus.HistogramVec
+	redelivery      *prometheus.HistogramVec
+	publishDuration *prometheus.HistogramVec
+	pending         *prometheus.GaugeVec
+	ackPending      *prometheus.GaugeVec
+}
+
+// Metrics 注册在 metrics.Registry 中的默认指标
+var Metrics = NewMQMetrics(metrics.Registry)
+
+func NewMQMetrics(reg prometheus.Registerer) *MQMetrics {
+	subLabels := []string{"system", "topic", "subscription"}
+	m := &MQMetrics{
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mq_consumer_received_total",
+			Help: "Messages received by consumers.",
+		}, subLabels),
+		acked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mq_consumer_acked_total",
+			Help: "Messages acknowledged after successful handling.",
+		}, subLabels),
+		nacked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mq_consumer_nacked_total",
+			Help: "Messages negatively acknowledged for redelivery.",
+		}, subLabels),
+		deadLettered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mq_consumer_dead_lettered_total",
+			Help: "Failed messages that will not be redelivered.",
+		}, subLabels),
+		handleDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mq_consumer_handle_duration_seconds",
+			Help:    "Message listener duration.",
+			Buckets: prometheus.DefBuckets,
+		}, append(subLabels, "result")),
+		redelivery: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mq_consumer_redelivery_count",
+			Help:    "Redelivery count of received messages.",
+			Buckets: []float64{0, 1, 2, 3, 5, 10, 20, 50},
+		}, subLabels),
+		publishDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mq_producer_publish_duration_seconds",
+			Help:    "Publish latency until the broker confirms the message.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"system", "topic", "result"}),
+		pending: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mq_consumer_pending_messages",
+			Help: "Messages not yet delivered to the consumer.",
+		}, subLabels),
+		ackPending: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mq_consumer_ack_pending_messages",
+			Help: "Messages delivered but not yet acknowledged.",
+		}, subLabels),
+	}
+	reg.MustRegister(m.received, m.acked, m.nacked, m.deadLettered, m.handleDuration, m.redelivery, m.publishDuration, m.pending, m.ackPending)
+	return m
+}
+
+func result(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultOk
+}
+
+func (m *MQMetrics) Received(system, topic, subscription string, redeliveryCount uint64) {
+	m.received.WithLabelValues(system, topic, subscription).Inc()
+	m.redelivery.WithLabelValues(system, topic, subscription).Observe(float64(redeliveryCount))
+}
+
+func (m *MQMetrics) Acked(system, topic, subscription string) {
+	m.acked.WithLabelValues(system, topic, subscription).Inc()
+}
+
+func (m *MQMetrics) Nacked(system, topic, subscription string) {
+	m.nacked.WithLabelValues(system, topic, subscription).Inc()
+}
+
+func (m *MQMetrics) DeadLettered(system, topic, subscription string) {
+	m.deadLettered.WithLabelValues(system, topic, subscription).Inc()
+}
+
+func (m *MQMetrics) Handled(system, topic, subscription string, start time.Time, err error) {
+	m.handleDuration.WithLabelValues(system, topic, subscription, result(err)).Observe(time.Since(start).Seconds())
+}
+
+func (m *MQMetrics) Published(system, topic string, start time.Time, err error) {
+	m.publishDuration.WithLabelValues(system, topic, result(err)).Observe(time.Since(start).Seconds())
+}
+
+func (m *MQMetrics) SetPending(system, topic, subscription string, pending, ackPending uint64) {
+	m.pending.WithLabelValues(system, topic, subscription).Set(float64(pending))
+	m.ackPending.WithLabelValues(system, topic, subscription).Set(float64(ackPending))
+}
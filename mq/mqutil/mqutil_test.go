@@ -0,0 +1,85 @@
+package mqutil
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/skirrund/gcloud-plugins/metrics"
+	"github.com/skirrund/gcloud/mq"
+)
+
+func TestPayloadHashId(t *testing.T) {
+	m1 := &mq.Message{Topic: "orders", Payload: []byte(`{"id":1}`)}
+	m2 := &mq.Message{Topic: "orders", Payload: []byte(`{"id":1}`)}
+	m3 := &mq.Message{Topic: "orders-v2", Payload: []byte(`{"id":1}`)}
+	id := SetPayloadHashId(m1)
+	if id != SetPayloadHashId(m2) {
+		t.Error("same topic and payload should have the same id")
+	}
+	if id == SetPayloadHashId(m3) {
+		t.Error("different topic should have different id")
+	}
+	if MessageId(m1) != id {
+		t.Error("MessageId not match")
+	}
+	SetMessageId(m1, "order-1")
+	if MessageId(m1) != "order-1" {
+		t.Error("SetMessageId not applied")
+	}
+}
+
+func TestBatcher(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches [][]int
+	)
+	b := NewBatcher(3, 50*time.Millisecond, func(items []int) {
+		mu.Lock()
+		batches = append(batches, items)
+		mu.Unlock()
+	})
+	for i := range 4 {
+		b.Add(i)
+	}
+	time.Sleep(150 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batches) != 2 || len(batches[0]) != 3 || len(batches[1]) != 1 {
+		t.Errorf("batches=%v", batches)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	Metrics.Received(SystemNats, "orders", "orders-sub", 2)
+	Metrics.Published(SystemPulsar, "orders", time.Now(), nil)
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, f := range families {
+		names[f.GetName()] = true
+	}
+	for _, name := range []string{"mq_consumer_received_total", "mq_consumer_redelivery_count", "mq_producer_publish_duration_seconds"} {
+		if !names[name] {
+			t.Errorf("metric %s not registered", name)
+		}
+	}
+}
+
+func TestLogOptionsFormat(t *testing.T) {
+	opts := &LogOptions{MaskFields: "user.phone,*.idCard"}
+	s := opts.Format([]byte(`{"user":{"phone":"13800000000","name":"a"},"items":[{"idCard":"123"}]}`))
+	if strings.Contains(s, "13800000000") || strings.Contains(s, "123") || !strings.Contains(s, `"name":"a"`) {
+		t.Errorf("mask failed:%s", s)
+	}
+	opts = &LogOptions{MaxPayloadLength: 4}
+	if s = opts.Format([]byte("abcdefgh")); s != "abcd...(8 bytes)" {
+		t.Errorf("truncate failed:%s", s)
+	}
+	if (&LogOptions{Level: LogLevelNone}).Sampled() || !(&LogOptions{Level: LogLevelError}).LogOnError() {
+		t.Error("level check failed")
+	}
+}
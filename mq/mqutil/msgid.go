@@ -0,0 +1,43 @@
+package mqutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/skirrund/gcloud/mq"
+)
+
+// MsgIdHeader 消息 ID 所在的 header，gnats 映射为 Nats-Msg-Id 由 broker 去重；
+// pulsar 仅作为同名 property 携带，broker 和消费端都不去重，需要时由业务按 MessageId 自行过滤
+const MsgIdHeader = "Msg-Id"
+
+// SetMessageId 设置消息 ID，用于发送端去重
+func SetMessageId(msg *mq.Message, id string) {
+	if msg.Header == nil {
+		msg.Header = make(map[string]string)
+	}
+	msg.Header[MsgIdHeader] = id
+}
+
+// SetPayloadHashId 以 topic 和 payload 的 sha256 作为消息 ID，相同内容的消息在去重窗口内只会存储一次
+func SetPayloadHashId(msg *mq.Message) string {
+	id := PayloadHash(msg.Topic, msg.Payload)
+	SetMessageId(msg, id)
+	return id
+}
+
+// MessageId 返回消息 ID，未设置时为空
+func MessageId(msg *mq.Message) string {
+	if msg.Header == nil {
+		return ""
+	}
+	return msg.Header[MsgIdHeader]
+}
+
+func PayloadHash(topic string, payload []byte) string {
+	h := sha256.New()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
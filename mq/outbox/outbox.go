@@ -0,0 +1,196 @@
+// Package outbox 事务发件箱：业务数据与待发送消息在同一个事务中写入 Store，由 Relay 异步发送到 mq.IClient
+package outbox
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/mq"
+	"github.com/skirrund/gcloud/utils"
+)
+
+type Status int
+
+const (
+	StatusPending Status = iota
+	StatusSent
+	// StatusDead 超过最大重试次数，不再发送
+	StatusDead
+)
+
+// Record 一条待发送的消息，相同 AggregateKey 的消息按 Id 顺序发送，AggregateKey 为空时不保证顺序
+type Record struct {
+	Id            int64
+	AggregateKey  string
+	Topic         string
+	Payload       []byte
+	Header        map[string]string
+	DeliverAt     time.Time
+	Status        Status
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+	SentAt        time.Time
+}
+
+// Store 持久化 Record，Add 需要与业务数据在同一个事务中执行才能保证不丢消息
+type Store interface {
+	Add(ctx context.Context, records ...*Record) error
+	// Pending 返回 StatusPending 且 NextAttemptAt 不晚于 now 的记录，按 Id 升序；
+	// 同一 AggregateKey 中更早的待发送记录未到重试时间时，不返回该 AggregateKey 后续的记录
+	Pending(ctx context.Context, now time.Time, limit int) ([]*Record, error)
+	MarkSent(ctx context.Context, id int64, sentAt time.Time) error
+	// MarkFailed 保存 Status、Attempts、NextAttemptAt、LastError
+	MarkFailed(ctx context.Context, rec *Record) error
+	// Cleanup 删除 sentBefore 之前已发送的记录
+	Cleanup(ctx context.Context, sentBefore time.Time) (int64, error)
+}
+
+// Locker Store 可选实现，多个 Relay 共用一个 Store 时通过租约保证同一时间只有一个 Relay 发送
+type Locker interface {
+	// TryLock 获取或续期 owner 的租约，租约被其他 owner 持有且未过期时返回 false
+	TryLock(ctx context.Context, owner string, ttl time.Duration) (bool, error)
+	// Unlock 释放 owner 持有的租约，Relay.Stop 时调用
+	Unlock(ctx context.Context, owner string) error
+}
+
+// NewRecord 由 mq.Message 生成 Record，未设置消息 ID 时生成一个，重试发送时保持不变以便接收端去重
+func NewRecord(aggregateKey string, msg *mq.Message) *Record {
+	now := time.Now()
+	rec := &Record{
+		AggregateKey: aggregateKey,
+		Topic:        msg.Topic,
+		Payload:      msg.Payload,
+		Header:       maps.Clone(msg.Header),
+		DeliverAt:    msg.DeliverAt,
+		CreatedAt:    now,
+	}
+	if rec.DeliverAt.IsZero() && msg.DeliverAfter > 0 {
+		rec.DeliverAt = now.Add(msg.DeliverAfter)
+	}
+	if rec.Header == nil {
+		rec.Header = make(map[string]string)
+	}
+	if len(rec.Header[mqutil.MsgIdHeader]) == 0 {
+		rec.Header[mqutil.MsgIdHeader] = utils.Uuid()
+	}
+	return rec
+}
+
+func (r *Record) message() *mq.Message {
+	msg := &mq.Message{
+		Topic:   r.Topic,
+		Payload: r.Payload,
+		Header:  maps.Clone(r.Header),
+	}
+	if r.DeliverAt.After(time.Now()) {
+		msg.DeliverAt = r.DeliverAt
+	}
+	return msg
+}
+
+// MemoryStore 内存实现，用于测试或允许丢失消息的场景
+type MemoryStore struct {
+	mu      sync.Mutex
+	records []*Record
+	nextId  int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Add(ctx context.Context, records ...*Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range records {
+		s.nextId++
+		r.Id = s.nextId
+		c := *r
+		s.records = append(s.records, &c)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Pending(ctx context.Context, now time.Time, limit int) ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var (
+		res     []*Record
+		blocked = make(map[string]bool)
+	)
+	for _, r := range s.records {
+		if r.Status != StatusPending || blocked[r.AggregateKey] {
+			continue
+		}
+		if r.NextAttemptAt.After(now) {
+			if len(r.AggregateKey) > 0 {
+				blocked[r.AggregateKey] = true
+			}
+			continue
+		}
+		c := *r
+		res = append(res, &c)
+		if limit > 0 && len(res) >= limit {
+			break
+		}
+	}
+	return res, nil
+}
+
+func (s *MemoryStore) MarkSent(ctx context.Context, id int64, sentAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r := s.find(id); r != nil {
+		r.Status = StatusSent
+		r.SentAt = sentAt
+	}
+	return nil
+}
+
+func (s *MemoryStore) MarkFailed(ctx context.Context, rec *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r := s.find(rec.Id); r != nil {
+		r.Status = rec.Status
+		r.Attempts = rec.Attempts
+		r.NextAttemptAt = rec.NextAttemptAt
+		r.LastError = rec.LastError
+	}
+	return nil
+}
+
+func (s *MemoryStore) Cleanup(ctx context.Context, sentBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.records)
+	s.records = slices.DeleteFunc(s.records, func(r *Record) bool {
+		return r.Status == StatusSent && r.SentAt.Before(sentBefore)
+	})
+	return int64(n - len(s.records)), nil
+}
+
+// Records 返回全部记录的副本
+func (s *MemoryStore) Records() []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]Record, len(s.records))
+	for i, r := range s.records {
+		res[i] = *r
+	}
+	return res
+}
+
+func (s *MemoryStore) find(id int64) *Record {
+	for _, r := range s.records {
+		if r.Id == id {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/skirrund/gcloud-plugins/mq/memmq"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/mq"
+)
+
+// failClient 前 failures 次发送失败
+type failClient struct {
+	*memmq.Broker
+	failures int
+}
+
+func (c *failClient) Send(msg *mq.Message) error {
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("broker unavailable")
+	}
+	return c.Broker.Send(msg)
+}
+
+func TestRelay(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	broker := memmq.New()
+	defer broker.Close()
+	client := &failClient{Broker: broker, failures: 1}
+	store.Add(ctx,
+		NewRecord("order-1", &mq.Message{Topic: "orders", Payload: []byte("created")}),
+		NewRecord("order-1", &mq.Message{Topic: "orders", Payload: []byte("paid")}),
+		NewRecord("order-2", &mq.Message{Topic: "orders", Payload: []byte("created")}),
+	)
+	relay := NewRelay(store, client, RelayOptions{Concurrency: 1, Backoff: func(int) time.Duration { return 0 }})
+
+	// order-1 第一条失败，后续消息不能越过它发送
+	if n, err := relay.RunOnce(ctx); err != nil || n != 1 {
+		t.Fatalf("first run sent=%d,err=%v", n, err)
+	}
+	if n, err := relay.RunOnce(ctx); err != nil || n != 2 {
+		t.Fatalf("second run sent=%d,err=%v", n, err)
+	}
+	sent := broker.Sent("orders")
+	if len(sent) != 3 || string(sent[1].Payload) != "created" || string(sent[2].Payload) != "paid" {
+		t.Errorf("unexpected order")
+	}
+	if len(mqutil.MessageId(sent[0])) == 0 {
+		t.Error("message id not set")
+	}
+	if n, _ := store.Cleanup(ctx, time.Now().Add(time.Second)); n != 3 {
+		t.Errorf("cleanup=%d", n)
+	}
+}
+
+func TestSQLStorePlaceholders(t *testing.T) {
+	s := NewSQLStore(nil, DialectPostgres, "")
+	if p := s.placeholders(2, 3); p != "$2,$3,$4" {
+		t.Errorf("placeholders=%s", p)
+	}
+	if p := NewSQLStore(nil, DialectMySQL, "").placeholders(1, 2); p != "?,?" {
+		t.Errorf("placeholders=%s", p)
+	}
+}
+
+func TestMemoryStorePending(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := NewMemoryStore()
+	store.Add(ctx,
+		&Record{AggregateKey: "a", NextAttemptAt: now.Add(time.Minute)},
+		&Record{AggregateKey: "a"},
+		&Record{AggregateKey: "b"},
+		&Record{NextAttemptAt: now.Add(time.Minute)},
+		&Record{},
+		&Record{AggregateKey: "b", NextAttemptAt: now.Add(-time.Second)},
+	)
+	records, _ := store.Pending(ctx, now, 0)
+	var ids []int64
+	for _, r := range records {
+		ids = append(ids, r.Id)
+	}
+	// a 的第一条未到重试时间，后续记录不能越过它
+	if !slices.Equal(ids, []int64{3, 5, 6}) {
+		t.Errorf("pending=%v", ids)
+	}
+	if records, _ = store.Pending(ctx, now.Add(2*time.Minute), 2); len(records) != 2 || records[0].Id != 1 {
+		t.Errorf("pending after backoff=%v", len(records))
+	}
+}
+
+func TestSQLStorePendingQuery(t *testing.T) {
+	now := time.Now()
+	query, args := NewSQLStore(nil, DialectPostgres, "").pendingQuery(now, 10)
+	if !strings.Contains(query, "next_attempt_at<=$2") || !strings.Contains(query, "p.next_attempt_at>$4") || !strings.HasSuffix(query, "LIMIT $5") {
+		t.Errorf("query=%s", query)
+	}
+	if len(args) != 5 || args[1] != now.UnixMilli() || args[4] != 10 {
+		t.Errorf("args=%v", args)
+	}
+	if query, args = NewSQLStore(nil, DialectMySQL, "").pendingQuery(now, 0); strings.Count(query, "?") != 4 || len(args) != 4 {
+		t.Errorf("query=%s,args=%v", query, args)
+	}
+}
+
+// lockStore 只有 owner 持有租约时才能发送
+type lockStore struct {
+	*MemoryStore
+	owner string
+}
+
+func (s *lockStore) Unlock(ctx context.Context, owner string) error {
+	if s.owner == owner {
+		s.owner = ""
+	}
+	return nil
+}
+
+func (s *lockStore) TryLock(ctx context.Context, owner string, ttl time.Duration) (bool, error) {
+	if len(s.owner) == 0 {
+		s.owner = owner
+	}
+	return s.owner == owner, nil
+}
+
+func TestRelayLock(t *testing.T) {
+	store := &lockStore{MemoryStore: NewMemoryStore()}
+	broker := memmq.New()
+	defer broker.Close()
+	r1 := NewRelay(store, broker, RelayOptions{})
+	r2 := NewRelay(store, broker, RelayOptions{})
+	if !r1.lock(context.Background()) || r2.lock(context.Background()) {
+		t.Error("only one relay should hold the lock")
+	}
+	if !NewRelay(NewMemoryStore(), broker, RelayOptions{}).lock(context.Background()) {
+		t.Error("store without locker should always send")
+	}
+	// Stop 释放租约，其他 Relay 可以立即接管
+	r1.Start()
+	r1.Stop()
+	if !r2.lock(context.Background()) {
+		t.Error("lock should be released on stop")
+	}
+}
+
+func TestRelayStopWithoutStart(t *testing.T) {
+	r := NewRelay(NewMemoryStore(), nil, RelayOptions{})
+	done := make(chan struct{})
+	go func() {
+		r.Stop()
+		r.Start()
+		r.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("stop without start should not block")
+	}
+}
+
+func TestSQLStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	s := NewSQLStore(db, DialectMySQL, "")
+	now := time.Now()
+
+	rec := NewRecord("order-1", &mq.Message{Topic: "orders", Payload: []byte("a")})
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO mq_outbox (aggregate_key,")).
+		WithArgs("order-1", "orders", []byte("a"), sqlmock.AnyArg(), 0, 0, 0, 0, "", rec.CreatedAt.UnixMilli(), 0).
+		WillReturnResult(sqlmock.NewResult(7, 1))
+	if err = s.Add(ctx, rec); err != nil || rec.Id != 7 {
+		t.Errorf("add id=%d,%v", rec.Id, err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM mq_outbox o WHERE status=? AND next_attempt_at<=?")).
+		WithArgs(0, now.UnixMilli(), 0, now.UnixMilli(), 10).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "aggregate_key", "topic", "payload", "header", "deliver_at", "status", "attempts", "next_attempt_at", "last_error", "created_at", "sent_at"}).
+			AddRow(7, "order-1", "orders", []byte("a"), `{"Msg-Id":"id-1"}`, 0, 0, 1, now.UnixMilli(), nil, now.UnixMilli(), 0))
+	records, err := s.Pending(ctx, now, 10)
+	if err != nil || len(records) != 1 {
+		t.Fatalf("pending=%v,%v", records, err)
+	}
+	if r := records[0]; r.Id != 7 || r.Header[mqutil.MsgIdHeader] != "id-1" || r.Attempts != 1 || !r.DeliverAt.IsZero() || r.NextAttemptAt.UnixMilli() != now.UnixMilli() {
+		t.Errorf("record=%+v", r)
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE mq_outbox SET status=?,sent_at=? WHERE id=?")).
+		WithArgs(1, now.UnixMilli(), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err = s.MarkSent(ctx, 7, now); err != nil {
+		t.Error(err)
+	}
+
+	// 首次获取租约时并发插入冲突，返回 false 而不是错误
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE mq_outbox_lock SET owner=?")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT owner FROM mq_outbox_lock")).WithArgs("mq_outbox").WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO mq_outbox_lock")).WillReturnError(errors.New("duplicate entry"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT owner FROM mq_outbox_lock")).WillReturnRows(sqlmock.NewRows([]string{"owner"}).AddRow("relay-2"))
+	if ok, err := s.TryLock(ctx, "relay-1", time.Minute); ok || err != nil {
+		t.Errorf("lock conflict=%v,%v", ok, err)
+	}
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE mq_outbox_lock SET owner=?")).
+		WithArgs("relay-2", sqlmock.AnyArg(), "mq_outbox", "relay-2", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if ok, err := s.TryLock(ctx, "relay-2", time.Minute); !ok || err != nil {
+		t.Errorf("renew=%v,%v", ok, err)
+	}
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE mq_outbox_lock SET expires_at=0 WHERE name=? AND owner=?")).
+		WithArgs("mq_outbox", "relay-2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err = s.Unlock(ctx, "relay-2"); err != nil {
+		t.Error(err)
+	}
+
+	// postgres 通过 RETURNING 获取 id
+	pg := NewSQLStore(db, DialectPostgres, "")
+	mock.ExpectQuery(regexp.QuoteMeta("VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) RETURNING id")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	rec = NewRecord("", &mq.Message{Topic: "orders"})
+	if err = pg.Add(ctx, rec); err != nil || rec.Id != 9 {
+		t.Errorf("postgres add id=%d,%v", rec.Id, err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
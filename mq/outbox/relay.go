@@ -0,0 +1,262 @@
+package outbox
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/mq"
+	"github.com/skirrund/gcloud/utils"
+)
+
+const (
+	DefaultInterval        = time.Second
+	DefaultBatchSize       = 100
+	DefaultMaxAttempts     = 10
+	DefaultConcurrency     = 8
+	DefaultRetention       = 24 * time.Hour
+	DefaultCleanupInterval = 10 * time.Minute
+	DefaultLockTTL         = 30 * time.Second
+)
+
+type RelayOptions struct {
+	// Interval 轮询 Store 的间隔，默认 DefaultInterval
+	Interval time.Duration
+	// BatchSize 每次读取的记录数，默认 DefaultBatchSize
+	BatchSize int
+	// MaxAttempts 超过后记录标记为 StatusDead，同一 AggregateKey 的后续消息继续发送，默认 DefaultMaxAttempts
+	MaxAttempts int
+	// Backoff 第 attempts 次失败后的重试延迟，默认 1s*2^(attempts-1)，最大 5 分钟
+	Backoff func(attempts int) time.Duration
+	// Concurrency 同时发送的 AggregateKey 数，默认 DefaultConcurrency
+	Concurrency int
+	// Retention 已发送记录的保留时间，默认 DefaultRetention，小于0时不清理
+	Retention time.Duration
+	// CleanupInterval 默认 DefaultCleanupInterval
+	CleanupInterval time.Duration
+	// LockTTL Store 实现 Locker 时的租约时长，需要大于一轮发送的耗时，默认 DefaultLockTTL
+	LockTTL time.Duration
+}
+
+func (o RelayOptions) withDefaults() RelayOptions {
+	if o.Interval <= 0 {
+		o.Interval = DefaultInterval
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = DefaultBatchSize
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = DefaultMaxAttempts
+	}
+	if o.Backoff == nil {
+		o.Backoff = defaultBackoff
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultConcurrency
+	}
+	if o.Retention == 0 {
+		o.Retention = DefaultRetention
+	}
+	if o.CleanupInterval <= 0 {
+		o.CleanupInterval = DefaultCleanupInterval
+	}
+	if o.LockTTL <= 0 {
+		o.LockTTL = DefaultLockTTL
+	}
+	return o
+}
+
+func defaultBackoff(attempts int) time.Duration {
+	d := time.Second * time.Duration(math.Pow(2, float64(min(attempts-1, 10))))
+	return min(d, 5*time.Minute)
+}
+
+// Relay 轮询 Store 并通过 mq.IClient 发送，发送成功后标记为已发送；至少发送一次，接收端可按消息 ID 去重。
+// Store 未实现 Locker 时只能运行一个 Relay，否则同一条记录会被重复发送
+type Relay struct {
+	store   Store
+	client  mq.IClient
+	opts    RelayOptions
+	owner   string
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	started atomic.Bool
+}
+
+func NewRelay(store Store, client mq.IClient, opts RelayOptions) *Relay {
+	return &Relay{
+		store:  store,
+		client: client,
+		opts:   opts.withDefaults(),
+		owner:  utils.Uuid(),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start 在后台运行，Stop 结束，重复调用或 Stop 后调用无效
+func (r *Relay) Start() {
+	if r.started.CompareAndSwap(false, true) {
+		go r.run()
+	}
+}
+
+// Stop 等待当前一轮发送完成并释放租约后返回，未 Start 时直接返回
+func (r *Relay) Stop() {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+	if r.started.CompareAndSwap(false, true) {
+		close(r.done)
+		return
+	}
+	<-r.done
+}
+
+func (r *Relay) run() {
+	defer close(r.done)
+	logger.Info("[outbox]relay started")
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+	lastCleanup := time.Now()
+	ctx := context.Background()
+	for {
+		select {
+		case <-r.stop:
+			r.unlock(ctx)
+			logger.Info("[outbox]relay stopped")
+			return
+		case <-ticker.C:
+		}
+		// 一批全部发送时继续读取下一批
+		for {
+			if !r.lock(ctx) {
+				break
+			}
+			n, err := r.RunOnce(ctx)
+			if err != nil {
+				logger.Error("[outbox]relay error:", err.Error())
+			}
+			if err != nil || n < r.opts.BatchSize {
+				break
+			}
+		}
+		if r.opts.Retention > 0 && time.Since(lastCleanup) >= r.opts.CleanupInterval {
+			lastCleanup = time.Now()
+			if n, err := r.store.Cleanup(ctx, time.Now().Add(-r.opts.Retention)); err != nil {
+				logger.Error("[outbox]cleanup error:", err.Error())
+			} else if n > 0 {
+				logger.Info("[outbox]cleanup sent records:", n)
+			}
+		}
+	}
+}
+
+// lock Store 实现 Locker 时获取或续期租约，未获取到时本轮不发送
+func (r *Relay) lock(ctx context.Context) bool {
+	locker, ok := r.store.(Locker)
+	if !ok {
+		return true
+	}
+	locked, err := locker.TryLock(ctx, r.owner, r.opts.LockTTL)
+	if err != nil {
+		logger.Error("[outbox]relay lock error:", err.Error())
+	}
+	return locked
+}
+
+// unlock 释放租约，其他 Relay 无需等待租约过期即可接管
+func (r *Relay) unlock(ctx context.Context) {
+	if locker, ok := r.store.(Locker); ok {
+		if err := locker.Unlock(ctx, r.owner); err != nil {
+			logger.Error("[outbox]relay unlock error:", err.Error())
+		}
+	}
+}
+
+// RunOnce 读取一批记录并发送，返回发送成功的条数；不获取 Locker 租约，多个 Relay 时由调用方保证只有一个在发送
+func (r *Relay) RunOnce(ctx context.Context) (int, error) {
+	records, err := r.store.Pending(ctx, time.Now(), r.opts.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		groups [][]*Record
+		index  = make(map[string]int)
+	)
+	for _, rec := range records {
+		if len(rec.AggregateKey) == 0 {
+			groups = append(groups, []*Record{rec})
+			continue
+		}
+		i, ok := index[rec.AggregateKey]
+		if !ok {
+			i = len(groups)
+			index[rec.AggregateKey] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], rec)
+	}
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		sent int
+		sem  = make(chan struct{}, r.opts.Concurrency)
+	)
+	for _, g := range groups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			n := r.sendGroup(ctx, g)
+			mu.Lock()
+			sent += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return sent, nil
+}
+
+// sendGroup 按顺序发送同一 AggregateKey 的记录，遇到未到重试时间或发送失败的记录时停止
+func (r *Relay) sendGroup(ctx context.Context, records []*Record) int {
+	sent := 0
+	now := time.Now()
+	for _, rec := range records {
+		if rec.NextAttemptAt.After(now) {
+			return sent
+		}
+		err := r.client.Send(rec.message())
+		if err == nil {
+			if err = r.store.MarkSent(ctx, rec.Id, time.Now()); err != nil {
+				logger.Error("[outbox]mark sent error:", rec.Id, ",", err.Error())
+				return sent
+			}
+			sent++
+			continue
+		}
+		rec.Attempts++
+		rec.LastError = err.Error()
+		if rec.Attempts >= r.opts.MaxAttempts {
+			rec.Status = StatusDead
+			logger.Error("[outbox]give up record:", rec.Id, ",topic:", rec.Topic, ",attempts:", rec.Attempts, ",error:", err.Error())
+		} else {
+			rec.NextAttemptAt = time.Now().Add(r.opts.Backoff(rec.Attempts))
+			logger.Error("[outbox]send error:", rec.Id, ",topic:", rec.Topic, ",attempts:", rec.Attempts, ",error:", err.Error())
+		}
+		if e := r.store.MarkFailed(ctx, rec); e != nil {
+			logger.Error("[outbox]mark failed error:", rec.Id, ",", e.Error())
+		}
+		if rec.Status != StatusDead {
+			return sent
+		}
+	}
+	return sent
+}
@@ -0,0 +1,247 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skirrund/gcloud/utils"
+)
+
+type Dialect int
+
+const (
+	// DialectMySQL 使用 ? 占位符和 LastInsertId
+	DialectMySQL Dialect = iota
+	// DialectPostgres 使用 $n 占位符和 RETURNING id
+	DialectPostgres
+)
+
+const DefaultTable = "mq_outbox"
+
+// Execer *sql.DB 和 *sql.Tx 都满足该接口
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// SQLStore database/sql 实现，时间以 unix 毫秒存储，表结构见 CreateTableSQL；
+// 实现 Locker，多个 Relay 通过 CreateLockTableSQL 建的租约表保证同一时间只有一个在发送
+type SQLStore struct {
+	db      *sql.DB
+	table   string
+	dialect Dialect
+}
+
+// NewSQLStore table 为空时使用 DefaultTable
+func NewSQLStore(db *sql.DB, dialect Dialect, table string) *SQLStore {
+	if len(table) == 0 {
+		table = DefaultTable
+	}
+	return &SQLStore{db: db, table: table, dialect: dialect}
+}
+
+// CreateTableSQL 返回建表语句，数据量大时建议在 (status,next_attempt_at) 和 (aggregate_key,status,id) 上建索引
+func (s *SQLStore) CreateTableSQL() string {
+	id := "id BIGINT AUTO_INCREMENT PRIMARY KEY"
+	payload := "LONGBLOB"
+	if s.dialect == DialectPostgres {
+		id = "id BIGSERIAL PRIMARY KEY"
+		payload = "BYTEA"
+	}
+	return "CREATE TABLE IF NOT EXISTS " + s.table + " (" +
+		id + "," +
+		"aggregate_key VARCHAR(255) NOT NULL DEFAULT ''," +
+		"topic VARCHAR(512) NOT NULL," +
+		"payload " + payload + "," +
+		"header TEXT," +
+		"deliver_at BIGINT NOT NULL DEFAULT 0," +
+		"status INT NOT NULL DEFAULT 0," +
+		"attempts INT NOT NULL DEFAULT 0," +
+		"next_attempt_at BIGINT NOT NULL DEFAULT 0," +
+		"last_error TEXT," +
+		"created_at BIGINT NOT NULL," +
+		"sent_at BIGINT NOT NULL DEFAULT 0)"
+}
+
+// CreateLockTableSQL 返回 Relay 租约表的建表语句，表名为 <table>_lock
+func (s *SQLStore) CreateLockTableSQL() string {
+	return "CREATE TABLE IF NOT EXISTS " + s.lockTable() + " (" +
+		"name VARCHAR(255) PRIMARY KEY," +
+		"owner VARCHAR(64) NOT NULL," +
+		"expires_at BIGINT NOT NULL)"
+}
+
+func (s *SQLStore) lockTable() string {
+	return s.table + "_lock"
+}
+
+// TryLock 租约未过期时只有 owner 可以续期，过期后由第一个 Relay 接管
+func (s *SQLStore) TryLock(ctx context.Context, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	expiresAt := millis(now.Add(ttl))
+	res, err := s.db.ExecContext(ctx, "UPDATE "+s.lockTable()+" SET owner="+s.placeholders(1, 1)+",expires_at="+s.placeholders(2, 1)+
+		" WHERE name="+s.placeholders(3, 1)+" AND (owner="+s.placeholders(4, 1)+" OR expires_at<"+s.placeholders(5, 1)+")",
+		owner, expiresAt, s.table, owner, millis(now))
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return true, nil
+	}
+	// mysql 值未变化时 RowsAffected 为0，需要再确认当前 owner
+	var current string
+	err = s.db.QueryRowContext(ctx, "SELECT owner FROM "+s.lockTable()+" WHERE name="+s.placeholders(1, 1), s.table).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err = s.db.ExecContext(ctx, "INSERT INTO "+s.lockTable()+" (name,owner,expires_at) VALUES ("+s.placeholders(1, 3)+")", s.table, owner, expiresAt); err == nil {
+			return true, nil
+		}
+		// 并发插入时主键冲突，租约已被其他 Relay 获取
+		if e := s.db.QueryRowContext(ctx, "SELECT owner FROM "+s.lockTable()+" WHERE name="+s.placeholders(1, 1), s.table).Scan(&current); e != nil {
+			return false, err
+		}
+	} else if err != nil {
+		return false, err
+	}
+	return current == owner, nil
+}
+
+// Unlock 将 owner 持有的租约置为过期
+func (s *SQLStore) Unlock(ctx context.Context, owner string) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE "+s.lockTable()+" SET expires_at=0 WHERE name="+s.placeholders(1, 1)+" AND owner="+s.placeholders(2, 1),
+		s.table, owner)
+	return err
+}
+
+// Add 使用 db 写入，需要与业务数据在同一个事务中写入时使用 AddTx
+func (s *SQLStore) Add(ctx context.Context, records ...*Record) error {
+	return s.AddTx(ctx, s.db, records...)
+}
+
+// AddTx 在调用方的事务中写入
+func (s *SQLStore) AddTx(ctx context.Context, tx Execer, records ...*Record) error {
+	query := "INSERT INTO " + s.table + " (aggregate_key,topic,payload,header,deliver_at,status,attempts,next_attempt_at,last_error,created_at,sent_at) VALUES (" + s.placeholders(1, 11) + ")"
+	if s.dialect == DialectPostgres {
+		query += " RETURNING id"
+	}
+	for _, r := range records {
+		header, err := utils.Marshal(r.Header)
+		if err != nil {
+			return err
+		}
+		args := []any{r.AggregateKey, r.Topic, r.Payload, string(header), millis(r.DeliverAt), int(r.Status), r.Attempts, millis(r.NextAttemptAt), r.LastError, millis(r.CreatedAt), millis(r.SentAt)}
+		if s.dialect == DialectPostgres {
+			if err = tx.QueryRowContext(ctx, query, args...).Scan(&r.Id); err != nil {
+				return err
+			}
+			continue
+		}
+		res, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		if r.Id, err = res.LastInsertId(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) Pending(ctx context.Context, now time.Time, limit int) ([]*Record, error) {
+	query, args := s.pendingQuery(now, limit)
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []*Record
+	for rows.Next() {
+		var (
+			r                                           Record
+			header, lastError                           sql.NullString
+			status                                      int
+			deliverAt, nextAttemptAt, createdAt, sentAt int64
+		)
+		if err = rows.Scan(&r.Id, &r.AggregateKey, &r.Topic, &r.Payload, &header, &deliverAt, &status, &r.Attempts, &nextAttemptAt, &lastError, &createdAt, &sentAt); err != nil {
+			return nil, err
+		}
+		if len(header.String) > 0 {
+			if err = utils.Unmarshal([]byte(header.String), &r.Header); err != nil {
+				return nil, errors.New("[outbox] invalid header of record " + strconv.FormatInt(r.Id, 10) + ":" + err.Error())
+			}
+		}
+		r.Status = Status(status)
+		r.LastError = lastError.String
+		r.DeliverAt = fromMillis(deliverAt)
+		r.NextAttemptAt = fromMillis(nextAttemptAt)
+		r.CreatedAt = fromMillis(createdAt)
+		r.SentAt = fromMillis(sentAt)
+		res = append(res, &r)
+	}
+	return res, rows.Err()
+}
+
+// pendingQuery 同一 aggregate_key 存在更早的未到重试时间的待发送记录时跳过，保证顺序
+func (s *SQLStore) pendingQuery(now time.Time, limit int) (string, []any) {
+	query := "SELECT id,aggregate_key,topic,payload,header,deliver_at,status,attempts,next_attempt_at,last_error,created_at,sent_at FROM " + s.table + " o" +
+		" WHERE status=" + s.placeholders(1, 1) + " AND next_attempt_at<=" + s.placeholders(2, 1) +
+		" AND (aggregate_key='' OR NOT EXISTS (SELECT 1 FROM " + s.table + " p WHERE p.aggregate_key=o.aggregate_key AND p.status=" + s.placeholders(3, 1) +
+		" AND p.id<o.id AND p.next_attempt_at>" + s.placeholders(4, 1) + ")) ORDER BY id"
+	args := []any{int(StatusPending), millis(now), int(StatusPending), millis(now)}
+	if limit > 0 {
+		query += " LIMIT " + s.placeholders(5, 1)
+		args = append(args, limit)
+	}
+	return query, args
+}
+
+func (s *SQLStore) MarkSent(ctx context.Context, id int64, sentAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE "+s.table+" SET status="+s.placeholders(1, 1)+",sent_at="+s.placeholders(2, 1)+" WHERE id="+s.placeholders(3, 1),
+		int(StatusSent), millis(sentAt), id)
+	return err
+}
+
+func (s *SQLStore) MarkFailed(ctx context.Context, rec *Record) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE "+s.table+" SET status="+s.placeholders(1, 1)+",attempts="+s.placeholders(2, 1)+",next_attempt_at="+s.placeholders(3, 1)+",last_error="+s.placeholders(4, 1)+" WHERE id="+s.placeholders(5, 1),
+		int(rec.Status), rec.Attempts, millis(rec.NextAttemptAt), rec.LastError, rec.Id)
+	return err
+}
+
+func (s *SQLStore) Cleanup(ctx context.Context, sentBefore time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM "+s.table+" WHERE status="+s.placeholders(1, 1)+" AND sent_at<"+s.placeholders(2, 1),
+		int(StatusSent), millis(sentBefore))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// placeholders 从第 start 个参数开始生成 n 个占位符
+func (s *SQLStore) placeholders(start, n int) string {
+	ps := make([]string, n)
+	for i := range ps {
+		if s.dialect == DialectPostgres {
+			ps[i] = "$" + strconv.Itoa(start+i)
+		} else {
+			ps[i] = "?"
+		}
+	}
+	return strings.Join(ps, ",")
+}
+
+func millis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func fromMillis(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
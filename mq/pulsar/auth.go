@@ -0,0 +1,109 @@
+package pulsar
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apache/pulsar-client-go/pulsar/auth"
+)
+
+// clientOptions 根据 Options 生成 pulsar.ClientOptions，配置冲突或文件不可读时返回错误
+func clientOptions(opt Options) (pulsar.ClientOptions, error) {
+	co := pulsar.ClientOptions{
+		URL:                        opt.Url,
+		ConnectionTimeout:          defaultConnectionTimeout,
+		OperationTimeout:           defaultOperationTimeout,
+		MaxConnectionsPerBroker:    runtime.NumCPU(),
+		ListenerName:               opt.ListenerName,
+		TLSTrustCertsFilePath:      opt.TLSTrustCertsFile,
+		TLSAllowInsecureConnection: opt.TLSAllowInsecureConnection,
+		TLSValidateHostname:        opt.TLSValidateHostname,
+		EnableTransaction:          opt.EnableTransaction,
+	}
+	if len(opt.Url) == 0 {
+		return co, errors.New("[pulsar] pulsar.service-url is empty")
+	}
+	if opt.ConnectionTimeoutSecond > 0 {
+		co.ConnectionTimeout = time.Duration(opt.ConnectionTimeoutSecond) * time.Second
+	}
+	if opt.OperationTimeoutSecond > 0 {
+		co.OperationTimeout = time.Duration(opt.OperationTimeoutSecond) * time.Second
+	}
+	if opt.MaxConnectionsPerBroker > 0 {
+		co.MaxConnectionsPerBroker = opt.MaxConnectionsPerBroker
+	}
+	if len(opt.TLSTrustCertsFile) > 0 {
+		if err := checkFile("pulsar.tls.trustCertsFile", opt.TLSTrustCertsFile); err != nil {
+			return co, err
+		}
+	}
+
+	methods := 0
+	if len(opt.Token) > 0 {
+		methods++
+	}
+	if len(opt.TokenFile) > 0 {
+		methods++
+	}
+	if len(opt.OAuth2IssuerUrl) > 0 {
+		methods++
+	}
+	if len(opt.TLSCert) > 0 || len(opt.TLSKey) > 0 {
+		methods++
+	}
+	if methods > 1 {
+		return co, errors.New("[pulsar] only one of pulsar.token, pulsar.tokenFile, pulsar.oauth2, pulsar.tls.cert can be set")
+	}
+	switch {
+	case len(opt.Token) > 0:
+		co.Authentication = pulsar.NewAuthenticationToken(opt.Token)
+	case len(opt.TokenFile) > 0:
+		if err := checkFile("pulsar.tokenFile", opt.TokenFile); err != nil {
+			return co, err
+		}
+		co.Authentication = pulsar.NewAuthenticationTokenFromFile(opt.TokenFile)
+	case len(opt.OAuth2IssuerUrl) > 0:
+		if err := checkFile("pulsar.oauth2.privateKey", opt.OAuth2PrivateKey); err != nil {
+			return co, err
+		}
+		params := map[string]string{
+			auth.ConfigParamType:      auth.ConfigParamTypeClientCredentials,
+			auth.ConfigParamIssuerURL: opt.OAuth2IssuerUrl,
+			auth.ConfigParamAudience:  opt.OAuth2Audience,
+			auth.ConfigParamKeyFile:   opt.OAuth2PrivateKey,
+		}
+		if len(opt.OAuth2Scope) > 0 {
+			params[auth.ConfigParamScope] = opt.OAuth2Scope
+		}
+		if len(opt.OAuth2ClientId) > 0 {
+			params[auth.ConfigParamClientID] = opt.OAuth2ClientId
+		}
+		co.Authentication = pulsar.NewAuthenticationOAuth2(params)
+	case len(opt.TLSCert) > 0 || len(opt.TLSKey) > 0:
+		if err := checkFile("pulsar.tls.cert", opt.TLSCert); err != nil {
+			return co, err
+		}
+		if err := checkFile("pulsar.tls.key", opt.TLSKey); err != nil {
+			return co, err
+		}
+		co.Authentication = pulsar.NewAuthenticationTLS(opt.TLSCert, opt.TLSKey)
+	}
+	return co, nil
+}
+
+func checkFile(key, path string) error {
+	if len(path) == 0 {
+		return errors.New("[pulsar] " + key + " is empty")
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return errors.New("[pulsar] " + key + " can not be read:" + err.Error())
+	}
+	if fi.IsDir() {
+		return errors.New("[pulsar] " + key + " is a directory:" + path)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package pulsar
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/skirrund/gcloud/logger"
+)
+
+const (
+	CodecJSONString = "json-string"
+	CodecBytes      = "bytes"
+)
+
+// Codec 负责 mq.Message.Payload 与 pulsar 消息之间的编解码，Schema 在创建 producer/consumer 时注册到 broker
+type Codec interface {
+	Schema() pulsar.Schema
+	Encode(payload []byte, msg *pulsar.ProducerMessage)
+	Decode(msg pulsar.Message) ([]byte, error)
+}
+
+// DefaultCodec 兼容原有行为，payload 作为 json 字符串编码
+var DefaultCodec Codec = JSONStringCodec()
+
+type jsonStringCodec struct {
+	schema pulsar.Schema
+}
+
+func JSONStringCodec() Codec {
+	return &jsonStringCodec{schema: pulsar.NewJSONSchema(`"string"`, nil)}
+}
+
+func (c *jsonStringCodec) Schema() pulsar.Schema {
+	return c.schema
+}
+
+func (c *jsonStringCodec) Encode(payload []byte, msg *pulsar.ProducerMessage) {
+	msg.Value = string(payload)
+}
+
+func (c *jsonStringCodec) Decode(msg pulsar.Message) ([]byte, error) {
+	var s string
+	err := c.schema.Decode(msg.Payload(), &s)
+	return []byte(s), err
+}
+
+// schemaCodec payload 原样收发，schema 仅用于注册和兼容性校验
+type schemaCodec struct {
+	schema pulsar.Schema
+}
+
+// BytesCodec payload 原样收发，不注册 schema
+func BytesCodec() Codec {
+	return &schemaCodec{}
+}
+
+// AvroCodec payload 为 avro 二进制，可通过 Schema().Encode 由结构体生成
+func AvroCodec(schemaDef string, properties map[string]string) (Codec, error) {
+	schema, err := pulsar.NewAvroSchemaWithValidation(schemaDef, properties)
+	if err != nil {
+		return nil, errors.New("[pulsar] avro schema error:" + err.Error())
+	}
+	return &schemaCodec{schema: schema}, nil
+}
+
+// ProtoCodec payload 为 protobuf 序列化后的二进制，schemaDef 为 protobuf 对应的 avro 定义
+func ProtoCodec(schemaDef string, properties map[string]string) (Codec, error) {
+	schema, err := pulsar.NewProtoSchemaWithValidation(schemaDef, properties)
+	if err != nil {
+		return nil, errors.New("[pulsar] protobuf schema error:" + err.Error())
+	}
+	return &schemaCodec{schema: schema}, nil
+}
+
+// SchemaCodec 使用自定义 schema，payload 原样收发
+func SchemaCodec(schema pulsar.Schema) Codec {
+	return &schemaCodec{schema: schema}
+}
+
+func (c *schemaCodec) Schema() pulsar.Schema {
+	return c.schema
+}
+
+func (c *schemaCodec) Encode(payload []byte, msg *pulsar.ProducerMessage) {
+	msg.Payload = payload
+}
+
+func (c *schemaCodec) Decode(msg pulsar.Message) ([]byte, error) {
+	return msg.Payload(), nil
+}
+
+// CodecByName 根据配置名称返回 codec，avro/protobuf 需要 schema 定义，请使用 AvroCodec/ProtoCodec
+func CodecByName(name string) (Codec, error) {
+	switch strings.ToLower(name) {
+	case "", CodecJSONString:
+		return DefaultCodec, nil
+	case CodecBytes:
+		return BytesCodec(), nil
+	default:
+		return nil, errors.New("[pulsar] unknown codec:" + name)
+	}
+}
+
+// RegisterCodec 指定 topic 的 codec，需要在该 topic 第一次发送或订阅前调用
+func (pc *PulsarClient) RegisterCodec(topic string, codec Codec) {
+	pc.codecs.Store(topicKey(topic), codec)
+}
+
+// codec 优先使用 RegisterCodec 指定的 codec，其次为配置 pulsar.producer.codec
+func (pc *PulsarClient) codec(topic string) Codec {
+	topic = topicKey(topic)
+	if c, ok := pc.codecs.Load(topic); ok {
+		return c.(Codec)
+	}
+	codec, err := CodecByName(pc.producerOptions(topic).Codec)
+	if err != nil {
+		logger.Error(err.Error())
+		codec = DefaultCodec
+	}
+	c, _ := pc.codecs.LoadOrStore(topic, codec)
+	return c.(Codec)
+}
+
+// topicCodec 多 topic 订阅时按消息所属 topic 查找 codec，不注册 schema
+type topicCodec struct {
+	pc *PulsarClient
+}
+
+func (c *topicCodec) Schema() pulsar.Schema {
+	return nil
+}
+
+func (c *topicCodec) Encode(payload []byte, msg *pulsar.ProducerMessage) {
+	DefaultCodec.Encode(payload, msg)
+}
+
+func (c *topicCodec) Decode(msg pulsar.Message) ([]byte, error) {
+	return c.pc.codec(msg.Topic()).Decode(msg)
+}
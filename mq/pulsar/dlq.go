@@ -0,0 +1,202 @@
+package pulsar
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/logger"
+)
+
+const (
+	DefaultNackRedeliveryDelay   = 15 * time.Second
+	DefaultReplaySubscription    = "gcloud-dlq-replay"
+	DefaultReplayIdleTimeout     = 5 * time.Second
+	defaultReplayReceiveInterval = time.Second
+)
+
+// DLQOptions 失败消息超过 MaxDeliveries 后由 pulsar 发送到死信 topic，配置后不再受 ACKMode 限制
+type DLQOptions struct {
+	// MaxDeliveries 最大投递次数，默认 RetryTimes+1
+	MaxDeliveries uint32
+	// DeadLetterTopic 默认 <topic>-<subscription>-DLQ
+	DeadLetterTopic string
+	// Retry 为 true 或 RetryLetterTopic 非空时，失败消息通过重试 topic 延迟重新投递，否则使用 Nack
+	Retry bool
+	// RetryLetterTopic 默认 <topic>-<subscription>-RETRY
+	RetryLetterTopic string
+	// InitialSubscriptionName 创建死信 topic 时的初始订阅，避免没有订阅时死信被删除
+	InitialSubscriptionName string
+}
+
+func (o *DLQOptions) retryEnabled() bool {
+	return o.Retry || len(o.RetryLetterTopic) > 0
+}
+
+type NackBackoffFunc func(redeliveryCount uint32) time.Duration
+
+func (f NackBackoffFunc) Next(redeliveryCount uint32) time.Duration {
+	return f(redeliveryCount)
+}
+
+// MaxNackBackoff ExponentialNackBackoff 未设置 max 时的延迟上限
+const MaxNackBackoff = 24 * time.Hour
+
+// ExponentialNackBackoff initial * 2^redeliveryCount，max>0 时封顶，否则最大 MaxNackBackoff
+func ExponentialNackBackoff(initial, max time.Duration) pulsar.NackBackoffPolicy {
+	if max <= 0 {
+		max = MaxNackBackoff
+	}
+	return NackBackoffFunc(func(n uint32) time.Duration {
+		// 在 float64 上比较，转换为 time.Duration 前封顶，避免溢出为负数
+		f := float64(initial) * math.Pow(2, float64(n))
+		if math.IsNaN(f) || f >= float64(max) {
+			return max
+		}
+		if d := time.Duration(f); d > 0 {
+			return d
+		}
+		return max
+	})
+}
+
+func (opts ConsumerOptions) dlqPolicy() *pulsar.DLQPolicy {
+	return &pulsar.DLQPolicy{
+		MaxDeliveries:           opts.DLQ.MaxDeliveries,
+		DeadLetterTopic:         opts.DLQ.DeadLetterTopic,
+		RetryLetterTopic:        opts.DLQ.RetryLetterTopic,
+		InitialSubscriptionName: opts.DLQ.InitialSubscriptionName,
+	}
+}
+
+// nackDelay 第 n 次重试的延迟
+func (opts ConsumerOptions) nackDelay(n uint32) time.Duration {
+	if opts.NackBackoff != nil {
+		return opts.NackBackoff.Next(n)
+	}
+	if opts.NackRedeliveryDelay > 0 {
+		return opts.NackRedeliveryDelay
+	}
+	return DefaultNackRedeliveryDelay
+}
+
+// retryOrDeadLetter 配置 DLQ 时的失败处理，超过 MaxDeliveries 后由 pulsar 转发到死信 topic
+func retryOrDeadLetter(logCtx context.Context, cm pulsar.ConsumerMessage, consumer pulsar.Consumer, opts ConsumerOptions) {
+	msg := cm.Message
+	maxDeliveries := opts.DLQ.MaxDeliveries
+	var deliveries uint32
+	if opts.DLQ.retryEnabled() {
+		reconsumeTimes, _ := strconv.Atoi(msg.Properties()[pulsar.SysPropertyReconsumeTimes])
+		deliveries = uint32(reconsumeTimes) + 1
+		delay := opts.nackDelay(deliveries)
+		logger.InfofContext(logCtx, "[pulsar]consummer error and reconsume later=> subscriptionName:"+cm.Subscription()+",maxDeliveries:%d,deliveries:%d,delay:%s", maxDeliveries, deliveries, delay)
+		consumer.ReconsumeLater(msg, delay)
+	} else {
+		deliveries = msg.RedeliveryCount() + 1
+		logger.InfofContext(logCtx, "[pulsar]consummer error and nack=> subscriptionName:"+cm.Subscription()+",maxDeliveries:%d,deliveries:%d", maxDeliveries, deliveries)
+		consumer.Nack(msg)
+	}
+	if deliveries >= maxDeliveries {
+		mqutil.Metrics.DeadLettered(mqutil.SystemPulsar, opts.Topic, opts.SubscriptionName)
+	} else {
+		mqutil.Metrics.Nacked(mqutil.SystemPulsar, opts.Topic, opts.SubscriptionName)
+	}
+}
+
+// ReplayOptions 死信回放配置
+type ReplayOptions struct {
+	// Target 回放的目标 topic，为空时使用死信的 REAL_TOPIC 属性，即原 topic
+	Target string
+	// SubscriptionName 读取死信 topic 的订阅名，默认 DefaultReplaySubscription
+	SubscriptionName string
+	// IdleTimeout 超过该时间没有新的死信则结束，默认 DefaultReplayIdleTimeout
+	IdleTimeout time.Duration
+	// Limit 大于0时最多回放的条数
+	Limit int
+}
+
+// ReplayDeadLetter 将死信 topic 中的消息原样发送回原 topic 并确认，返回回放的条数
+func (pc *PulsarClient) ReplayDeadLetter(ctx context.Context, dlqTopic string, opts ReplayOptions) (int, error) {
+	if len(dlqTopic) == 0 {
+		return 0, errors.New("[pulsar] dlq topic is empty")
+	}
+	if len(opts.SubscriptionName) == 0 {
+		opts.SubscriptionName = DefaultReplaySubscription
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultReplayIdleTimeout
+	}
+	consumer, err := pc.client.Subscribe(pulsar.ConsumerOptions{
+		Topic:                       dlqTopic,
+		SubscriptionName:            opts.SubscriptionName,
+		Type:                        pulsar.Shared,
+		SubscriptionInitialPosition: pulsar.SubscriptionPositionEarliest,
+		NackRedeliveryDelay:         defaultReplayReceiveInterval,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer consumer.Close()
+	logger.Info("[pulsar]start replay dlq:", dlqTopic, "=>", opts.Target)
+	count := 0
+	for opts.Limit <= 0 || count < opts.Limit {
+		rctx, cancel := context.WithTimeout(ctx, opts.IdleTimeout)
+		msg, err := consumer.Receive(rctx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return count, ctx.Err()
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+			return count, err
+		}
+		target := opts.Target
+		if len(target) == 0 {
+			target = msg.Properties()[pulsar.SysPropertyRealTopic]
+		}
+		if len(target) == 0 {
+			consumer.Nack(msg)
+			return count, errors.New("[pulsar] replay target topic is unknown:" + msg.ID().String())
+		}
+		p, release, err := pc.getProducer(target)
+		if err != nil {
+			consumer.Nack(msg)
+			return count, err
+		}
+		_, err = p.Send(ctx, replayMsg(msg))
+		release()
+		if err != nil {
+			consumer.Nack(msg)
+			return count, err
+		}
+		consumer.Ack(msg)
+		count++
+	}
+	logger.Info("[pulsar]finished replay dlq:", dlqTopic, ",count:", count)
+	return count, nil
+}
+
+// replayMsg 保留 payload、key、event time 和业务属性，去掉重试相关的属性
+func replayMsg(msg pulsar.Message) *pulsar.ProducerMessage {
+	props := make(map[string]string, len(msg.Properties()))
+	for k, v := range msg.Properties() {
+		switch k {
+		case pulsar.SysPropertyReconsumeTimes, pulsar.SysPropertyDelayTime, pulsar.SysPropertyRetryTopic:
+		default:
+			props[k] = v
+		}
+	}
+	return &pulsar.ProducerMessage{
+		Payload:     msg.Payload(),
+		Key:         msg.Key(),
+		OrderingKey: msg.OrderingKey(),
+		EventTime:   msg.EventTime(),
+		Properties:  props,
+	}
+}
@@ -0,0 +1,69 @@
+package pulsar
+
+import (
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/mq"
+)
+
+// Options pulsar 客户端配置，超时单位为秒以兼容 NewClient
+type Options struct {
+	Url                     string `property:"pulsar.service-url"`
+	AppName                 string `property:"pulsar.appName"`
+	ConnectionTimeoutSecond int64  `property:"pulsar.connectionTimeout"`
+	OperationTimeoutSecond  int64  `property:"pulsar.operationTimeout"`
+	MaxConnectionsPerBroker int    `property:"pulsar.maxConnectionsPerBroker"`
+	ListenerName            string `property:"pulsar.listenerName"`
+	// Token、TokenFile、OAuth2、TLS 客户端证书只能配置一种
+	Token     string `property:"pulsar.token"`
+	TokenFile string `property:"pulsar.tokenFile"`
+	// OAuth2 client_credentials 认证，OAuth2PrivateKey 为 key 文件路径
+	OAuth2IssuerUrl  string `property:"pulsar.oauth2.issuerUrl"`
+	OAuth2Audience   string `property:"pulsar.oauth2.audience"`
+	OAuth2Scope      string `property:"pulsar.oauth2.scope"`
+	OAuth2ClientId   string `property:"pulsar.oauth2.clientId"`
+	OAuth2PrivateKey string `property:"pulsar.oauth2.privateKey"`
+	// TLS 使用 pulsar+ssl:// 地址时生效，配置 TLSCert/TLSKey 时使用证书认证
+	TLSTrustCertsFile          string `property:"pulsar.tls.trustCertsFile"`
+	TLSCert                    string `property:"pulsar.tls.cert"`
+	TLSKey                     string `property:"pulsar.tls.key"`
+	TLSAllowInsecureConnection bool   `property:"pulsar.tls.allowInsecureConnection"`
+	TLSValidateHostname        bool   `property:"pulsar.tls.validateHostname"`
+	// EnableTransaction 使用 BeginTxn 或 TxnListener 时需要开启
+	EnableTransaction bool `property:"pulsar.enableTransaction"`
+	// ProducerCacheSize 缓存的 producer 上限，默认 DefaultProducerCacheSize
+	ProducerCacheSize int `property:"pulsar.producer.cacheSize"`
+	// ProducerIdleTimeout producer 空闲超过该时间后关闭，默认 DefaultProducerIdleTimeout，小于0时不关闭
+	ProducerIdleTimeout time.Duration `property:"pulsar.producer.idleTimeout"`
+}
+
+// ConsumerOptions 在 mq.ConsumerOptions 基础上增加 pulsar 专有的订阅配置
+type ConsumerOptions struct {
+	mq.ConsumerOptions
+	// Topics 同时订阅多个 topic，与 Topic、TopicsPattern 只能配置一种，消息来源见 mq.Message.Topic
+	Topics []string
+	// TopicsPattern 按正则订阅同一 namespace 下的 topic，如 persistent://public/default/audit-.*
+	TopicsPattern string
+	// AutoDiscoveryPeriod TopicsPattern 发现新 topic 的周期，默认 1 分钟
+	AutoDiscoveryPeriod time.Duration
+	// MaxConcurrency 同时处理的消息数上限，默认等于 MaxMessageChannelSize
+	MaxConcurrency int
+	// TxnListener 非空时在事务中处理并确认消息，忽略 MessageListener
+	TxnListener TxnListener
+	// TxnTimeout 默认 DefaultTxnTimeout
+	TxnTimeout time.Duration
+	// Batch 非空时使用 Batch.Listener 批量处理，忽略 MessageListener 和 TxnListener
+	Batch *mqutil.BatchOptions
+	// Log payload 日志配置，为空时使用 mqutil.DefaultLogOptions
+	Log *mqutil.LogOptions
+	// Codec payload 解码方式，为空时使用 RegisterCodec 指定的 codec，否则使用 DefaultCodec；多 topic 订阅时按消息所属 topic 查找
+	Codec Codec
+	// DLQ 非空时启用死信 topic，可选使用重试 topic
+	DLQ *DLQOptions
+	// NackBackoff Nack 和重试 topic 的延迟策略，为空时固定使用 NackRedeliveryDelay
+	NackBackoff pulsar.NackBackoffPolicy
+	// NackRedeliveryDelay 默认 DefaultNackRedeliveryDelay
+	NackRedeliveryDelay time.Duration
+}
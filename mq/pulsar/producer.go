@@ -3,9 +3,10 @@ package pulsar
 import (
 	"context"
 	"errors"
+	"strconv"
+	"time"
 
-	//	"sync"
-
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
 	"github.com/skirrund/gcloud/logger"
 	"github.com/skirrund/gcloud/mq"
 	"github.com/skirrund/gcloud/tracer"
@@ -13,37 +14,23 @@ import (
 	"github.com/apache/pulsar-client-go/pulsar"
 )
 
-var producers = make(map[string]pulsar.Producer)
-
-func (pc *PulsarClient) getProducer(topic string) (pulsar.Producer, error) {
-	p, ok := producers[topic]
-	if ok && p != nil {
-		logger.Info("[pulsar]load producer fromcache1:", topic, ",", true)
-		return p, nil
-	}
-	pc.mt.Lock()
-	defer pc.mt.Unlock()
-	p, ok = producers[topic]
-	var err error
-	if !ok || p == nil {
-		p, err = createProducer(topic)
-		producers[topic] = p
-	} else {
-		logger.Info("[pulsar]load producer fromcache2:", topic, ",", true)
-	}
-
-	return p, err
+// getProducer 使用完成后需要调用 release
+func (pc *PulsarClient) getProducer(topic string) (pulsar.Producer, func(), error) {
+	return pc.producers.get(topic, func() (pulsar.Producer, error) {
+		return pc.createProducer(topic, pc.codec(topic), pc.producerOptions(topic))
+	})
 }
 
-func createProducer(topic string) (pulsar.Producer, error) {
-	logger.Info("[pulsar]start create pulsar.Producer:", topic)
+func (pc *PulsarClient) createProducer(topic string, codec Codec, opts ProducerOptions) (pulsar.Producer, error) {
+	logger.Infof("[pulsar]start create pulsar.Producer:"+topic+",%+v", opts)
 	pp := pulsar.ProducerOptions{
 		Topic:  topic,
-		Name:   getAppName(pulsarClient.appName),
-		Schema: pulsar.NewJSONSchema(`"string"`, nil),
+		Name:   getAppName(pc.appName),
+		Schema: codec.Schema(),
 	}
+	opts.apply(&pp)
 
-	producer, err := pulsarClient.client.CreateProducer(pp)
+	producer, err := pc.client.CreateProducer(pp)
 	if err != nil {
 		logger.Error("[pulsar]error create pulsar.Producer:", err)
 	} else {
@@ -52,16 +39,34 @@ func createProducer(topic string) (pulsar.Producer, error) {
 	return producer, err
 }
 
-func createMsg(msg *mq.Message) *pulsar.ProducerMessage {
-	message := &pulsar.ProducerMessage{
-		Value: string(msg.Payload),
-	}
+// createMsg mqutil.MsgIdHeader 与其他 header 一样作为 property 发送，pulsar 不据此去重
+func createMsg(msg *mq.Message, codec Codec) *pulsar.ProducerMessage {
+	message := &pulsar.ProducerMessage{}
+	codec.Encode(msg.Payload, message)
 	if msg.DeliverAfter > 0 {
 		message.DeliverAfter = msg.DeliverAfter
 	}
 	if !msg.DeliverAt.IsZero() {
 		message.DeliverAt = msg.DeliverAt
 	}
+	for k, v := range msg.Header {
+		switch k {
+		case KeyHeader:
+			message.Key = v
+		case OrderingKeyHeader:
+			message.OrderingKey = v
+		case EventTimeHeader:
+			if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+				message.EventTime = time.UnixMilli(ms)
+			}
+		case MessageIdHeader:
+		default:
+			if message.Properties == nil {
+				message.Properties = make(map[string]string, len(msg.Header))
+			}
+			message.Properties[k] = v
+		}
+	}
 	return message
 }
 func (pc *PulsarClient) doSend(msg *mq.Message) error {
@@ -70,15 +75,34 @@ func (pc *PulsarClient) doSend(msg *mq.Message) error {
 		return errors.New("[pulsar] topic is empty")
 	}
 	logCtx := tracer.NewTraceIDContext()
-	logger.InfoContext(logCtx, "[pulsar] send msg =>topic:"+topic+":"+string(msg.Payload))
-	message := createMsg(msg)
-	producer, err := pc.getProducer(topic)
+	logOpts := mqutil.OrDefault(pc.producerOptions(topic).Log)
+	if logOpts.Sampled() {
+		logger.InfoContext(logCtx, "[pulsar] send msg =>topic:"+topic+":"+logOpts.Format(msg.Payload))
+	}
+	message := createMsg(msg, pc.codec(topic))
+	producer, release, err := pc.getProducer(topic)
 	if err != nil {
 		return err
 	}
+	start := time.Now()
 	msgId, err := producer.Send(context.Background(), message)
+	release()
+	if isFatalProducerError(err) {
+		pc.producers.remove(topic, producer)
+		// producer 被清理或关闭时消息未发送，重新创建后重试一次
+		if errors.Is(err, pulsar.ErrProducerClosed) {
+			if producer, release, err = pc.getProducer(topic); err == nil {
+				msgId, err = producer.Send(context.Background(), message)
+				release()
+			}
+		}
+	}
+	mqutil.Metrics.Published(mqutil.SystemPulsar, topic, start, err)
 	if err != nil {
 		logger.InfoContext(logCtx, "[pulsar]发送消息失败: ", err)
+		if logOpts.LogOnError() {
+			logger.ErrorContext(logCtx, "[pulsar] send error msg =>topic:"+topic+":"+logOpts.Format(msg.Payload))
+		}
 		return err
 	}
 	if msgId == nil {
@@ -95,14 +119,24 @@ func (pc *PulsarClient) doSendAsync(msg *mq.Message) error {
 		logger.Error(err.Error())
 		return err
 	}
-	message := createMsg(msg)
-	p, err := pc.getProducer(topic)
+	payload := msg.Payload
+	message := createMsg(msg, pc.codec(topic))
+	p, release, err := pc.getProducer(topic)
 	if err != nil {
 		return err
 	}
-	p.SendAsync(context.Background(), message, func(msgId pulsar.MessageID, msg *pulsar.ProducerMessage, err error) {
+	start := time.Now()
+	p.SendAsync(context.Background(), message, func(msgId pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+		release()
+		mqutil.Metrics.Published(mqutil.SystemPulsar, topic, start, err)
+		if isFatalProducerError(err) {
+			pc.producers.remove(topic, p)
+		}
 		if err != nil {
 			logger.Error("[pulsar]发送doSendAsync消息失败:", err)
+			if logOpts := mqutil.OrDefault(pc.producerOptions(topic).Log); logOpts.LogOnError() {
+				logger.Error("[pulsar] send async error msg =>topic:" + topic + ":" + logOpts.Format(payload))
+			}
 		} else {
 			logger.Info("[pulsar] doSendAsync finish:", msgId)
 		}
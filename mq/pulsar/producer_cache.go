@@ -0,0 +1,221 @@
+package pulsar
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/skirrund/gcloud/logger"
+)
+
+const (
+	DefaultProducerCacheSize   = 256
+	DefaultProducerIdleTimeout = 10 * time.Minute
+)
+
+var errClientClosed = errors.New("[pulsar] client is closed")
+
+type producerEntry struct {
+	producer pulsar.Producer
+	err      error
+	lastUsed atomic.Int64
+	// ready 创建完成后关闭，之后 producer 和 err 不再变化
+	ready chan struct{}
+	// done producer 关闭后关闭
+	done chan struct{}
+	// 以下字段由 producerCache.mu 保护
+	refs    int
+	evicted bool
+	closing bool
+}
+
+// producerCache 按 topic 缓存 producer，同一 topic 同时只创建一个，创建失败不缓存；
+// 空闲超时或超过容量时移除最久未使用的 producer，正在使用的 producer 在全部 release 后 flush 并关闭
+type producerCache struct {
+	mu          sync.Mutex
+	entries     map[string]*producerEntry
+	maxSize     int
+	idleTimeout time.Duration
+	closed      bool
+	stop        chan struct{}
+}
+
+func newProducerCache(maxSize int, idleTimeout time.Duration) *producerCache {
+	if maxSize <= 0 {
+		maxSize = DefaultProducerCacheSize
+	}
+	if idleTimeout == 0 {
+		idleTimeout = DefaultProducerIdleTimeout
+	}
+	c := &producerCache{
+		entries:     make(map[string]*producerEntry),
+		maxSize:     maxSize,
+		idleTimeout: idleTimeout,
+		stop:        make(chan struct{}),
+	}
+	// idleTimeout 小于0时不按空闲时间清理
+	if idleTimeout > 0 {
+		go c.evictLoop()
+	}
+	return c
+}
+
+// get 返回 topic 的 producer，在锁外调用 create；使用完成后必须调用 release，SendAsync 需要在回调中调用
+func (c *producerCache) get(topic string, create func() (pulsar.Producer, error)) (p pulsar.Producer, release func(), err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, nil, errClientClosed
+	}
+	e, ok := c.entries[topic]
+	if !ok {
+		if len(c.entries) >= c.maxSize {
+			c.evictOldest()
+		}
+		e = &producerEntry{ready: make(chan struct{}), done: make(chan struct{})}
+		c.entries[topic] = e
+	}
+	e.refs++
+	e.lastUsed.Store(time.Now().UnixNano())
+	c.mu.Unlock()
+	release = func() {
+		c.mu.Lock()
+		e.refs--
+		c.tryClose(topic, e)
+		c.mu.Unlock()
+	}
+	if ok {
+		<-e.ready
+	} else {
+		e.producer, e.err = create()
+		if e.err != nil {
+			c.mu.Lock()
+			c.evict(topic, e)
+			c.mu.Unlock()
+		}
+		close(e.ready)
+	}
+	if e.err != nil {
+		release()
+		return nil, nil, e.err
+	}
+	return e.producer, release, nil
+}
+
+// remove 移除 topic 当前的 producer，p 已被替换时不处理
+func (c *producerCache) remove(topic string, p pulsar.Producer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[topic]
+	if !ok {
+		return
+	}
+	select {
+	case <-e.ready:
+	default:
+		return
+	}
+	if e.producer != p {
+		return
+	}
+	logger.Info("[pulsar]remove producer:", topic)
+	c.evict(topic, e)
+}
+
+// evict 需要持有 c.mu
+func (c *producerCache) evict(topic string, e *producerEntry) {
+	if c.entries[topic] == e {
+		delete(c.entries, topic)
+	}
+	e.evicted = true
+	c.tryClose(topic, e)
+}
+
+// tryClose 需要持有 c.mu，已移除且没有使用者时关闭
+func (c *producerCache) tryClose(topic string, e *producerEntry) {
+	if !e.evicted || e.refs > 0 || e.closing {
+		return
+	}
+	e.closing = true
+	go func() {
+		defer close(e.done)
+		if e.producer != nil {
+			closeProducer(topic, e.producer)
+		}
+	}()
+}
+
+// evictOldest 需要持有 c.mu
+func (c *producerCache) evictOldest() {
+	var (
+		oldest string
+		last   int64
+	)
+	for topic, e := range c.entries {
+		if t := e.lastUsed.Load(); len(oldest) == 0 || t < last {
+			oldest, last = topic, t
+		}
+	}
+	if e, ok := c.entries[oldest]; ok {
+		logger.Info("[pulsar]evict producer over cache size:", oldest)
+		c.evict(oldest, e)
+	}
+}
+
+func (c *producerCache) evictLoop() {
+	ticker := time.NewTicker(c.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			deadline := time.Now().Add(-c.idleTimeout).UnixNano()
+			c.mu.Lock()
+			for topic, e := range c.entries {
+				if e.refs == 0 && e.lastUsed.Load() < deadline {
+					logger.Info("[pulsar]evict idle producer:", topic)
+					c.evict(topic, e)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// close 移除全部 producer 并等待关闭，正在使用的 producer 在 release 后关闭；之后 get 返回 errClientClosed
+func (c *producerCache) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.stop)
+	// evict 会从 c.entries 中删除，先复制再等待
+	entries := slices.Collect(maps.Values(c.entries))
+	for topic, e := range c.entries {
+		c.evict(topic, e)
+	}
+	c.mu.Unlock()
+	for _, e := range entries {
+		<-e.done
+	}
+}
+
+func closeProducer(topic string, p pulsar.Producer) {
+	if err := p.FlushWithCtx(context.Background()); err != nil {
+		logger.Error("[pulsar]flush producer error:", topic, ",", err.Error())
+	}
+	p.Close()
+}
+
+// isFatalProducerError producer 已不可用，需要重新创建
+func isFatalProducerError(err error) bool {
+	return errors.Is(err, pulsar.ErrProducerClosed) || errors.Is(err, pulsar.ErrProducerFenced) || errors.Is(err, pulsar.ErrTopicTerminated)
+}
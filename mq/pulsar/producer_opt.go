@@ -0,0 +1,185 @@
+package pulsar
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/bootstrap/env"
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/mq"
+	"github.com/skirrund/gcloud/utils"
+)
+
+// 以下 header 发送时转换为 pulsar 消息的 key、ordering key 和 event time，不作为 properties 发送；消费时从消息中还原
+const (
+	KeyHeader         = "Pulsar-Key"
+	OrderingKeyHeader = "Pulsar-Ordering-Key"
+	// EventTimeHeader unix 毫秒时间戳
+	EventTimeHeader = "Pulsar-Event-Time"
+)
+
+const producerTopicsPrefix = "pulsar.producer.topics."
+
+// ProducerOptions producer 配置，pulsar.producer.* 为全局默认值，
+// pulsar.producer.topics 列表按 topic 覆盖，每项的 topic 为完整或简写的 topic 名，其余字段同全局配置，如
+// pulsar.producer.topics.0.topic=persistent://public/default/orders.v1、pulsar.producer.topics.0.sendTimeout=3s
+type ProducerOptions struct {
+	DisableBatching         bool          `property:"pulsar.producer.disableBatching"`
+	BatchingMaxPublishDelay time.Duration `property:"pulsar.producer.batchingMaxPublishDelay"`
+	BatchingMaxMessages     uint          `property:"pulsar.producer.batchingMaxMessages"`
+	BatchingMaxSize         uint          `property:"pulsar.producer.batchingMaxSize"`
+	// CompressionType none、lz4、zlib、zstd
+	CompressionType    string        `property:"pulsar.producer.compressionType"`
+	SendTimeout        time.Duration `property:"pulsar.producer.sendTimeout"`
+	MaxPendingMessages int           `property:"pulsar.producer.maxPendingMessages"`
+	// Codec 未通过 RegisterCodec 指定时使用的 codec 名称，见 CodecByName；订阅同一 topic 时同样生效
+	Codec string `property:"pulsar.producer.codec"`
+	// Log 发送日志配置，为空时使用 mqutil.DefaultLogOptions，只能通过 SetProducerOptions 设置
+	Log *mqutil.LogOptions
+}
+
+func SetKey(msg *mq.Message, key string) {
+	setHeader(msg, KeyHeader, key)
+}
+
+func SetOrderingKey(msg *mq.Message, key string) {
+	setHeader(msg, OrderingKeyHeader, key)
+}
+
+func SetEventTime(msg *mq.Message, t time.Time) {
+	setHeader(msg, EventTimeHeader, strconv.FormatInt(t.UnixMilli(), 10))
+}
+
+func setHeader(msg *mq.Message, key, value string) {
+	if msg.Header == nil {
+		msg.Header = make(map[string]string)
+	}
+	msg.Header[key] = value
+}
+
+// SetProducerOptions 指定 topic 的 producer 配置，优先于配置文件，需要在该 topic 第一次发送前调用
+func (pc *PulsarClient) SetProducerOptions(topic string, opts ProducerOptions) {
+	pc.producerOpts.Store(topicKey(topic), opts)
+}
+
+func (pc *PulsarClient) producerOptions(topic string) ProducerOptions {
+	topic = topicKey(topic)
+	if opts, ok := pc.producerOpts.Load(topic); ok {
+		return opts.(ProducerOptions)
+	}
+	opts := ProducerOptions{}
+	utils.NewOptions(env.GetInstance(), &opts)
+	overrideTopicOptions(env.GetInstance(), &opts, topic)
+	actual, _ := pc.producerOpts.LoadOrStore(topic, opts)
+	return actual.(ProducerOptions)
+}
+
+type propertyGetter interface {
+	GetString(key string) string
+}
+
+const partitionSuffix = "-partition-"
+
+// topicKey 补全为 persistent://tenant/namespace/topic，去掉分区后缀，只有 topic 名时使用 public/default
+func topicKey(topic string) string {
+	if !strings.Contains(topic, "://") {
+		if !strings.Contains(topic, "/") {
+			topic = "public/default/" + topic
+		}
+		topic = "persistent://" + topic
+	}
+	if i := strings.LastIndex(topic, partitionSuffix); i > 0 {
+		if _, err := strconv.Atoi(topic[i+len(partitionSuffix):]); err == nil {
+			topic = topic[:i]
+		}
+	}
+	return topic
+}
+
+// overrideTopicOptions 在 pulsar.producer.topics 列表中查找 topic 相同的项覆盖全局配置，topic 为空时列表结束
+func overrideTopicOptions(cfg propertyGetter, opts *ProducerOptions, topic string) {
+	topic = topicKey(topic)
+	for n := 0; ; n++ {
+		prefix := producerTopicsPrefix + strconv.Itoa(n) + "."
+		name := cfg.GetString(prefix + "topic")
+		if len(name) == 0 {
+			return
+		}
+		if topicKey(name) == topic {
+			overrideOptions(cfg, opts, prefix)
+		}
+	}
+}
+
+// overrideOptions 读取 prefix+字段名 覆盖 property 标签对应的字段
+func overrideOptions(cfg propertyGetter, opts *ProducerOptions, prefix string) {
+	v := reflect.ValueOf(opts).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("property")
+		if len(tag) == 0 {
+			continue
+		}
+		key := prefix + tag[strings.LastIndex(tag, ".")+1:]
+		str := cfg.GetString(key)
+		if len(str) == 0 {
+			continue
+		}
+		f := v.Field(i)
+		var err error
+		switch {
+		case f.Type() == reflect.TypeOf(time.Duration(0)):
+			var d time.Duration
+			if d, err = time.ParseDuration(str); err == nil {
+				f.SetInt(int64(d))
+			}
+		case f.Kind() == reflect.Bool:
+			var b bool
+			if b, err = strconv.ParseBool(str); err == nil {
+				f.SetBool(b)
+			}
+		case f.Kind() == reflect.Int:
+			var n int64
+			if n, err = strconv.ParseInt(str, 10, 64); err == nil {
+				f.SetInt(n)
+			}
+		case f.Kind() == reflect.Uint:
+			var n uint64
+			if n, err = strconv.ParseUint(str, 10, 64); err == nil {
+				f.SetUint(n)
+			}
+		default:
+			f.SetString(str)
+		}
+		if err != nil {
+			logger.Error("[pulsar]producer config error:", key, ",", err.Error())
+		}
+	}
+}
+
+func compressionType(name string) pulsar.CompressionType {
+	switch strings.ToLower(name) {
+	case "lz4":
+		return pulsar.LZ4
+	case "zlib":
+		return pulsar.ZLib
+	case "zstd":
+		return pulsar.ZSTD
+	default:
+		return pulsar.NoCompression
+	}
+}
+
+func (opts ProducerOptions) apply(pp *pulsar.ProducerOptions) {
+	pp.DisableBatching = opts.DisableBatching
+	pp.BatchingMaxPublishDelay = opts.BatchingMaxPublishDelay
+	pp.BatchingMaxMessages = opts.BatchingMaxMessages
+	pp.BatchingMaxSize = opts.BatchingMaxSize
+	pp.CompressionType = compressionType(opts.CompressionType)
+	pp.SendTimeout = opts.SendTimeout
+	pp.MaxPendingMessages = opts.MaxPendingMessages
+}
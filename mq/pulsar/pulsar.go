@@ -1,13 +1,18 @@
 package pulsar
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"os"
-	"runtime"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/bootstrap/env"
 	"github.com/skirrund/gcloud/logger"
 	"github.com/skirrund/gcloud/mq"
 	"github.com/skirrund/gcloud/tracer"
@@ -21,15 +26,21 @@ type Message struct {
 }
 
 type PulsarClient struct {
-	client  pulsar.Client
-	appName string
-	mt      sync.Mutex
+	client    pulsar.Client
+	appName   string
+	producers *producerCache
+	codecs    sync.Map
+	// producerOpts topic => ProducerOptions
+	producerOpts sync.Map
+	// subs 未关闭的 *Subscription
+	subs sync.Map
 }
 
 const (
 	SERVER_URL_KEY           = "pulsar.service-url"
 	CONNECTION_TIMEOUT_KEY   = "pulsar.connectionTimeout"
 	OPERATION_TIMEOUT_KEY    = "pulsar.operationTimeout"
+	ServerName               = "server.name"
 	defaultConnectionTimeout = 5 * time.Second
 	defaultOperationTimeout  = 30 * time.Second
 )
@@ -39,51 +50,68 @@ const (
 )
 
 var pulsarClient *PulsarClient
-var once sync.Once
+var defaultMu sync.Mutex
 
 func init() {
 	os.Setenv("GODEBUG", "urlstrictcolons=0")
 }
 
+// NewClient 兼容原有用法，创建失败时 panic，建议使用 NewDefaultClient 或 NewClientWithOptions
 func NewClient(url string, connectionTimeoutSecond int64, operationTimeoutSecond int64, appName string) mq.IClient {
-	if pulsarClient != nil {
-		return pulsarClient
-	}
-	once.Do(func() {
-		pulsarClient = &PulsarClient{
-			client:  createClient(url, connectionTimeoutSecond, operationTimeoutSecond),
-			appName: appName,
-		}
+	pc, err := defaultClient(Options{
+		Url:                     url,
+		AppName:                 appName,
+		ConnectionTimeoutSecond: connectionTimeoutSecond,
+		OperationTimeoutSecond:  operationTimeoutSecond,
 	})
-	return pulsarClient
+	if err != nil {
+		panic(err)
+	}
+	return pc
+}
 
+// NewDefaultClient 从配置 pulsar.* 读取 Options，与 NewClient 共用同一个默认客户端，创建失败时下次调用会重试
+func NewDefaultClient() (*PulsarClient, error) {
+	opts := Options{}
+	cfg := env.GetInstance()
+	utils.NewOptions(cfg, &opts)
+	if len(opts.AppName) == 0 {
+		opts.AppName = cfg.GetString(ServerName)
+	}
+	return defaultClient(opts)
 }
 
-func createClient(url string, connectionTimeoutSecond int64, operationTimeoutSecond int64) pulsar.Client {
-	var cts time.Duration
-	var ots time.Duration
-	if connectionTimeoutSecond > 0 {
-		cts = time.Duration(connectionTimeoutSecond) * time.Second
-	} else {
-		cts = defaultConnectionTimeout
+func defaultClient(opts Options) (*PulsarClient, error) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if pulsarClient != nil {
+		return pulsarClient, nil
 	}
-	if operationTimeoutSecond > 0 {
-		ots = time.Duration(operationTimeoutSecond) * time.Second
-	} else {
-		ots = defaultOperationTimeout
-	}
-	logger.Infof("[pulsar]start init pulsar-client:" + url)
-	client, err := pulsar.NewClient(pulsar.ClientOptions{
-		URL:                     url,
-		ConnectionTimeout:       cts,
-		OperationTimeout:        ots,
-		MaxConnectionsPerBroker: runtime.NumCPU(),
-	})
+	pc, err := NewClientWithOptions(opts)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	pulsarClient = pc
+	return pc, nil
+}
+
+// NewClientWithOptions 每次调用都会创建新的客户端
+func NewClientWithOptions(opts Options) (*PulsarClient, error) {
+	co, err := clientOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("[pulsar]start init pulsar-client:" + opts.Url)
+	client, err := pulsar.NewClient(co)
+	if err != nil {
+		return nil, errors.New("[pulsar] init pulsar-client error:" + err.Error())
 	}
 	logger.Infof("[pulsar]finished init pulsar-client")
-	return client
+	return &PulsarClient{
+		client:    client,
+		appName:   opts.AppName,
+		producers: newProducerCache(opts.ProducerCacheSize, opts.ProducerIdleTimeout),
+	}, nil
 }
 
 func getAppName(appName string) string {
@@ -104,29 +132,108 @@ func (pc *PulsarClient) SendAsync(msg *mq.Message) error {
 }
 
 func (pc *PulsarClient) Subscribe(opts mq.ConsumerOptions) error {
-	go pc.doSubscribe(opts)
+	go pc.SubscribeWithOptionsSync(ConsumerOptions{ConsumerOptions: opts})
 	return nil
 }
 func (pc *PulsarClient) SubscribeSync(opts mq.ConsumerOptions) error {
-	return pc.doSubscribe(opts)
+	return pc.SubscribeWithOptionsSync(ConsumerOptions{ConsumerOptions: opts})
+}
+
+// SubscribeWithOptions 创建 consumer 后在后台消费，返回的 Subscription 用于关闭或取消订阅
+func (pc *PulsarClient) SubscribeWithOptions(opts ConsumerOptions) (*Subscription, error) {
+	sub, err := pc.subscribe(opts)
+	if err != nil {
+		return nil, err
+	}
+	go sub.run()
+	return sub, nil
 }
 
-func (pc *PulsarClient) doSubscribe(opts mq.ConsumerOptions) error {
+// SubscribeWithOptionsSync 阻塞消费直到 Subscription 被关闭
+func (pc *PulsarClient) SubscribeWithOptionsSync(opts ConsumerOptions) error {
+	sub, err := pc.subscribe(opts)
+	if err != nil {
+		return err
+	}
+	sub.run()
+	return nil
+}
+
+func checkTopics(opts ConsumerOptions) error {
+	n := 0
+	if len(opts.Topic) > 0 {
+		n++
+	}
+	if len(opts.Topics) > 0 {
+		n++
+	}
+	if len(opts.TopicsPattern) > 0 {
+		n++
+	}
+	if n == 0 {
+		return errors.New("[pulsar] topic is empty")
+	}
+	if n > 1 {
+		return errors.New("[pulsar] only one of Topic, Topics, TopicsPattern can be set")
+	}
+	return nil
+}
+
+func (pc *PulsarClient) subscribe(opts ConsumerOptions) (*Subscription, error) {
 	subscriptionName := opts.SubscriptionName
 	topic := opts.Topic
 	logger.Infof("[pulsar]ConsumerOptions:%+v", opts)
+	if err := checkTopics(opts); err != nil {
+		return nil, err
+	}
 	options := pulsar.ConsumerOptions{
 		Topic:               topic,
+		Topics:              opts.Topics,
+		TopicsPattern:       opts.TopicsPattern,
+		AutoDiscoveryPeriod: opts.AutoDiscoveryPeriod,
 		SubscriptionName:    subscriptionName,
 		Type:                pulsar.SubscriptionType(opts.SubscriptionType),
 		Name:                getAppName(pc.appName),
-		NackRedeliveryDelay: 15 * time.Second,
+		NackRedeliveryDelay: DefaultNackRedeliveryDelay,
+		NackBackoffPolicy:   opts.NackBackoff,
 		//Schema:              pulsar.NewStringSchema(nil),
 	}
+	if opts.NackRedeliveryDelay > 0 {
+		options.NackRedeliveryDelay = opts.NackRedeliveryDelay
+	}
 	if opts.RetryTimes == 0 {
 		opts.RetryTimes = MAX_RETRY_TIMES
 	}
-	schema := pulsar.NewJSONSchema(`"string"`, nil)
+	if opts.DLQ != nil {
+		dlq := *opts.DLQ
+		if dlq.MaxDeliveries == 0 {
+			dlq.MaxDeliveries = uint32(min(opts.RetryTimes, MAX_RETRY_TIMES)) + 1
+		}
+		opts.DLQ = &dlq
+		options.DLQ = opts.dlqPolicy()
+		options.RetryEnable = dlq.retryEnabled()
+	}
+	// 多 topic 订阅时 Topic 仅用于日志和指标
+	if len(topic) == 0 {
+		if len(opts.TopicsPattern) > 0 {
+			topic = opts.TopicsPattern
+		} else {
+			topic = strings.Join(opts.Topics, ",")
+		}
+		opts.Topic = topic
+	}
+	codec := opts.Codec
+	if codec == nil {
+		if len(opts.Topics) > 0 || len(opts.TopicsPattern) > 0 {
+			codec = &topicCodec{pc: pc}
+		} else {
+			codec = pc.codec(topic)
+		}
+	}
+	// 默认 codec 保持原有行为，consumer 不注册 schema
+	if _, ok := codec.(*jsonStringCodec); !ok {
+		options.Schema = codec.Schema()
+	}
 	channelSize := opts.MaxMessageChannelSize
 	if channelSize == 0 {
 		channelSize = 200
@@ -139,43 +246,133 @@ func (pc *PulsarClient) doSubscribe(opts mq.ConsumerOptions) error {
 		if opts.IsErrorPanic {
 			panic("[pulsar] Subscribe error:" + err.Error())
 		} else {
-			return err
+			return nil, err
 		}
 	}
 	logger.Infof("[pulsar]store consumerOptions:"+topic+":"+subscriptionName+",%+v", opts)
+	maxConcurrency := opts.MaxConcurrency
+	if maxConcurrency <= 0 {
+		maxConcurrency = channelSize
+	}
+	sub := &Subscription{
+		pc:       pc,
+		consumer: consumer,
+		codec:    codec,
+		opts:     opts,
+		channel:  channel,
+		sem:      make(chan struct{}, maxConcurrency),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	pc.subs.Store(sub, struct{}{})
+	return sub, nil
+}
 
-	for cm := range channel {
-		go func(cm pulsar.ConsumerMessage, consumer pulsar.Consumer, schema pulsar.Schema, opts mq.ConsumerOptions) {
-			consume(cm, consumer, schema, opts)
-		}(cm, consumer, schema, opts)
+// decodeMsg 解码消息并转换为 mq.Message
+func decodeMsg(logCtx context.Context, cm pulsar.ConsumerMessage, codec Codec, opts ConsumerOptions) *mq.Message {
+	msg := cm.Message
+	payload, err := codec.Decode(msg)
+	if logOpts := mqutil.OrDefault(opts.Log); logOpts.Sampled() {
+		logger.InfofContext(logCtx, "[pulsar] consumer info=>subName:%s,msgId:%v,reDeliveryCount:%d,publishTime:%v,producerName:%s", cm.Subscription(), msg.ID(), msg.RedeliveryCount(), msg.PublishTime(), msg.ProducerName())
+		if err != nil {
+			logger.InfoContext(logCtx, "[pulsar] consumer msg:", err.Error())
+		} else {
+			logger.InfoContext(logCtx, "[pulsar] consumer msg:", logOpts.Format(payload))
+		}
+	} else if err != nil {
+		logger.ErrorContext(logCtx, "[pulsar] consumer decode error:", err.Error())
 	}
-	return nil
+	mqutil.Metrics.Received(mqutil.SystemPulsar, opts.Topic, opts.SubscriptionName, uint64(msg.RedeliveryCount()))
+	return &mq.Message{
+		Topic:           msg.Topic(),
+		Payload:         payload,
+		Header:          toMqHeader(msg),
+		RedeliveryCount: uint64(msg.RedeliveryCount()),
+		SubOpts:         mq.SubOpts{Name: opts.SubscriptionName},
+	}
+}
+
+// toMqHeader properties 以及消息 ID、key、ordering key、event time 转换为 header
+func toMqHeader(msg pulsar.Message) map[string]string {
+	props := msg.Properties()
+	header := make(map[string]string, len(props)+4)
+	for k, v := range props {
+		header[k] = v
+	}
+	header[MessageIdHeader] = EncodeMessageId(msg.ID())
+	if len(msg.Key()) > 0 {
+		header[KeyHeader] = msg.Key()
+	}
+	if len(msg.OrderingKey()) > 0 {
+		header[OrderingKeyHeader] = msg.OrderingKey()
+	}
+	if !msg.EventTime().IsZero() {
+		header[EventTimeHeader] = strconv.FormatInt(msg.EventTime().UnixMilli(), 10)
+	}
+	return header
 }
-func consume(cm pulsar.ConsumerMessage, consumer pulsar.Consumer, schema pulsar.Schema, opts mq.ConsumerOptions) {
+
+func consume(cm pulsar.ConsumerMessage, consumer pulsar.Consumer, codec Codec, opts ConsumerOptions) {
 	logCtx := tracer.NewTraceIDContext()
 	defer func() {
 		if err := recover(); err != nil {
 			logger.ErrorContext(logCtx, "[pulsar] consumer panic recover :", err, "\n", string(debug.Stack()))
 		}
 	}()
-	msg := cm.Message
-	var msgStr string
-	logger.InfofContext(logCtx, "[pulsar] consumer info=>subName:%s,msgId:%v,reDeliveryCount:%d,publishTime:%v,producerName:%s", cm.Subscription(), msg.ID(), msg.RedeliveryCount(), msg.PublishTime(), msg.ProducerName())
-	err := schema.Decode(msg.Payload(), &msgStr)
-	if err != nil {
-		logger.InfoContext(logCtx, "[pulsar] consumer msg:", err.Error())
-	} else {
-		logger.InfoContext(logCtx, "[pulsar] consumer msg:", msgStr)
+	m := decodeMsg(logCtx, cm, codec, opts)
+	start := time.Now()
+	err := opts.MessageListener(logCtx, m)
+	mqutil.Metrics.Handled(mqutil.SystemPulsar, opts.Topic, opts.SubscriptionName, start, err)
+	finish(logCtx, cm, consumer, codec, opts, err)
+}
+
+func consumeBatch(cms []pulsar.ConsumerMessage, consumer pulsar.Consumer, codec Codec, opts ConsumerOptions, listener mqutil.BatchListener) {
+	logCtx := tracer.NewTraceIDContext()
+	messages := make([]*mq.Message, len(cms))
+	for i, cm := range cms {
+		messages[i] = decodeMsg(logCtx, cm, codec, opts)
 	}
-	err = opts.MessageListener(logCtx, &mq.Message{
-		Payload:         []byte(msgStr),
-		RedeliveryCount: uint64(msg.RedeliveryCount()),
-		SubOpts:         mq.SubOpts{Name: opts.SubscriptionName},
-	})
+	logger.InfofContext(logCtx, "[pulsar] consumer batch=>subName:%s,size:%d", opts.SubscriptionName, len(messages))
+	var errs []error
+	start := time.Now()
+	func() {
+		defer func() {
+			if e := recover(); e != nil {
+				logger.ErrorContext(logCtx, "[pulsar] batch consumer panic recover :", e, "\n", string(debug.Stack()))
+				err := errors.New(fmt.Sprint("[pulsar] batch consumer panic:", e))
+				errs = make([]error, len(messages))
+				for i := range errs {
+					errs[i] = err
+				}
+			}
+		}()
+		errs = listener(logCtx, messages)
+	}()
+	for i := range messages {
+		mqutil.Metrics.Handled(mqutil.SystemPulsar, opts.Topic, opts.SubscriptionName, start, mqutil.BatchResult(errs, i))
+	}
+	for i, cm := range cms {
+		finish(logCtx, cm, consumer, codec, opts, mqutil.BatchResult(errs, i))
+	}
+}
+
+// finish 根据处理结果 ack 或 nack
+func finish(logCtx context.Context, cm pulsar.ConsumerMessage, consumer pulsar.Consumer, codec Codec, opts ConsumerOptions, err error) {
+	msg := cm.Message
 	if err == nil {
 		consumer.Ack(msg)
+		mqutil.Metrics.Acked(mqutil.SystemPulsar, opts.Topic, opts.SubscriptionName)
 	} else {
 		logger.ErrorContext(logCtx, "[pulsar] consumer error:"+err.Error())
+		if logOpts := mqutil.OrDefault(opts.Log); logOpts.LogOnError() {
+			if payload, e := codec.Decode(msg); e == nil {
+				logger.ErrorContext(logCtx, "[pulsar] consumer error msg:", msg.Topic(), ",", logOpts.Format(payload))
+			}
+		}
+		if opts.DLQ != nil {
+			retryOrDeadLetter(logCtx, cm, consumer, opts)
+			return
+		}
 		retryTimes := uint64(0)
 		retryTimes = min(opts.RetryTimes, MAX_RETRY_TIMES)
 		ACKMode := uint32(opts.ACKMode)
@@ -183,14 +380,33 @@ func consume(cm pulsar.ConsumerMessage, consumer pulsar.Consumer, schema pulsar.
 		if ACKMode == 1 && rt < retryTimes {
 			logger.InfofContext(logCtx, "[pulsar]consummer error and retry=> subscriptionName:"+cm.Subscription()+",initRetryTimes:%d,retryTimes:%d,ack:%d", retryTimes, rt, ACKMode)
 			consumer.Nack(msg)
+			mqutil.Metrics.Nacked(mqutil.SystemPulsar, opts.Topic, opts.SubscriptionName)
 		} else {
 			logger.InfofContext(logCtx, "[pulsar]consummer error and can not retry=> subscriptionName:"+cm.Subscription()+",initRetryTimes:%d,retryTimes:%d,ack:%d", retryTimes, rt, ACKMode)
 			consumer.Ack(msg)
+			mqutil.Metrics.DeadLettered(mqutil.SystemPulsar, opts.Topic, opts.SubscriptionName)
 		}
 
 	}
 }
 
+// Close 先等待全部订阅处理中的消息完成，再 flush 并关闭全部 producer，保证异步发送的消息已发出，最后关闭客户端
 func (pc *PulsarClient) Close() {
+	var wg sync.WaitGroup
+	pc.subs.Range(func(key, _ any) bool {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key.(*Subscription).Close()
+		}()
+		return true
+	})
+	wg.Wait()
+	pc.producers.close()
 	pc.client.Close()
+	defaultMu.Lock()
+	if pulsarClient == pc {
+		pulsarClient = nil
+	}
+	defaultMu.Unlock()
 }
@@ -0,0 +1,642 @@
+package pulsar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/mq"
+)
+
+func TestProducerLogOptions(t *testing.T) {
+	pc := &PulsarClient{}
+	logOpts := &mqutil.LogOptions{Level: mqutil.LogLevelNone}
+	pc.SetProducerOptions("orders", ProducerOptions{Log: logOpts})
+	if opts := pc.producerOptions("orders"); opts.Log != logOpts {
+		t.Errorf("log options=%+v", opts.Log)
+	}
+	if opts := pc.producerOptions("payments"); mqutil.OrDefault(opts.Log) != mqutil.DefaultLogOptions {
+		t.Errorf("default log options=%+v", opts.Log)
+	}
+}
+
+// message 只实现测试用到的方法
+type message struct {
+	pulsar.Message
+	topic      string
+	payload    []byte
+	properties map[string]string
+}
+
+func (m *message) Topic() string                 { return m.topic }
+func (m *message) Payload() []byte               { return m.payload }
+func (m *message) Properties() map[string]string { return m.properties }
+func (m *message) ID() pulsar.MessageID          { return pulsar.EarliestMessageID() }
+func (m *message) RedeliveryCount() uint32       { return 0 }
+func (m *message) PublishTime() time.Time        { return time.Time{} }
+func (m *message) EventTime() time.Time          { return time.Time{} }
+func (m *message) ProducerName() string          { return "test" }
+func (m *message) Key() string                   { return "" }
+func (m *message) OrderingKey() string           { return "" }
+
+// sent 模拟 producer 按 schema 序列化后的消息
+func sent(t *testing.T, codec Codec, payload []byte) *message {
+	pm := &pulsar.ProducerMessage{}
+	codec.Encode(payload, pm)
+	data := pm.Payload
+	if pm.Value != nil {
+		var err error
+		if data, err = codec.Schema().Encode(pm.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &message{payload: data}
+}
+
+func TestCodec(t *testing.T) {
+	avro, err := AvroCodec(`{"type":"record","name":"Order","fields":[{"name":"id","type":"int"}]}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	avroPayload, err := avro.Schema().Encode(&struct {
+		Id int `avro:"id"`
+	}{Id: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		codec   Codec
+		payload []byte
+	}{
+		"json-string": {DefaultCodec, []byte(`{"id":1}`)},
+		"bytes":       {BytesCodec(), []byte{0, 1, 2}},
+		"avro":        {avro, avroPayload},
+	} {
+		got, err := tc.codec.Decode(sent(t, tc.codec, tc.payload))
+		if err != nil || !bytes.Equal(got, tc.payload) {
+			t.Errorf("%s decode=%v,%v", name, got, err)
+		}
+	}
+	if _, err = AvroCodec(`{"type":`, nil); err == nil {
+		t.Error("invalid avro schema should fail")
+	}
+	if _, err = CodecByName("xml"); err == nil {
+		t.Error("unknown codec should fail")
+	}
+	if c, err := CodecByName("BYTES"); err != nil || c.Schema() != nil {
+		t.Errorf("bytes codec=%v,%v", c, err)
+	}
+
+	pc := &PulsarClient{}
+	pc.SetProducerOptions("unknown", ProducerOptions{Codec: "xml"})
+	if c := pc.codec("unknown"); c != DefaultCodec {
+		t.Error("unknown codec should fall back to default")
+	}
+	pc.SetProducerOptions("registered", ProducerOptions{Codec: CodecBytes})
+	pc.RegisterCodec("registered", avro)
+	if c := pc.codec("registered"); c != avro {
+		t.Error("registered codec should take precedence")
+	}
+}
+
+type properties map[string]string
+
+func (p properties) GetString(key string) string {
+	return p[key]
+}
+
+func TestOverrideTopicOptions(t *testing.T) {
+	cfg := properties{
+		"pulsar.producer.topics.0.topic":                   "persistent://a/x/orders",
+		"pulsar.producer.topics.0.disableBatching":         "true",
+		"pulsar.producer.topics.0.batchingMaxPublishDelay": "20ms",
+		"pulsar.producer.topics.0.batchingMaxMessages":     "500",
+		"pulsar.producer.topics.0.maxPendingMessages":      "100",
+		"pulsar.producer.topics.0.compressionType":         "zstd",
+		"pulsar.producer.topics.1.topic":                   "orders",
+		"pulsar.producer.topics.1.sendTimeout":             "3s",
+		"pulsar.producer.topics.2.topic":                   "public/default/orders.v1",
+		"pulsar.producer.topics.2.sendTimeout":             "5s",
+	}
+	opts := ProducerOptions{SendTimeout: time.Second}
+	overrideTopicOptions(cfg, &opts, "persistent://a/x/orders")
+	want := ProducerOptions{DisableBatching: true, BatchingMaxPublishDelay: 20 * time.Millisecond, BatchingMaxMessages: 500, MaxPendingMessages: 100, CompressionType: "zstd", SendTimeout: time.Second}
+	if opts != want {
+		t.Errorf("a/x/orders=%+v", opts)
+	}
+	opts = ProducerOptions{}
+	overrideTopicOptions(cfg, &opts, "persistent://b/y/orders")
+	if opts != (ProducerOptions{}) {
+		t.Errorf("b/y/orders should not share a/x/orders config:%+v", opts)
+	}
+	overrideTopicOptions(cfg, &opts, "orders")
+	if opts.SendTimeout != 3*time.Second {
+		t.Errorf("orders=%+v", opts)
+	}
+	// topic 名包含 . 时不与其他 topic 混淆
+	opts = ProducerOptions{}
+	overrideTopicOptions(cfg, &opts, "orders.v1")
+	if opts.SendTimeout != 5*time.Second {
+		t.Errorf("orders.v1=%+v", opts)
+	}
+	opts = ProducerOptions{BatchingMaxMessages: 10}
+	overrideTopicOptions(properties{"pulsar.producer.topics.0.topic": "orders", "pulsar.producer.topics.0.batchingMaxMessages": "-1"}, &opts, "orders")
+	if opts.BatchingMaxMessages != 10 {
+		t.Errorf("invalid value should be ignored:%+v", opts)
+	}
+}
+
+func TestExponentialNackBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		initial, max time.Duration
+		n            uint32
+		want         time.Duration
+	}{
+		{time.Second, 0, 0, time.Second},
+		{time.Second, 0, 3, 8 * time.Second},
+		{time.Second, time.Minute, 10, time.Minute},
+		{time.Second, time.Minute, 34, time.Minute},
+		{time.Second, time.Minute, 50, time.Minute},
+		{time.Second, 0, 34, MaxNackBackoff},
+		{time.Second, 0, 1 << 31, MaxNackBackoff},
+		{0, time.Minute, 50, time.Minute},
+	} {
+		if d := ExponentialNackBackoff(tc.initial, tc.max).Next(tc.n); d != tc.want {
+			t.Errorf("ExponentialNackBackoff(%s,%s).Next(%d)=%s,want %s", tc.initial, tc.max, tc.n, d, tc.want)
+		}
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("test"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing")
+	url := "pulsar+ssl://localhost:6651"
+	for name, tc := range map[string]struct {
+		opt     Options
+		wantErr bool
+		auth    bool
+	}{
+		"empty url":       {opt: Options{}, wantErr: true},
+		"no auth":         {opt: Options{Url: url}},
+		"token":           {opt: Options{Url: url, Token: "t"}, auth: true},
+		"token file":      {opt: Options{Url: url, TokenFile: file}, auth: true},
+		"missing token":   {opt: Options{Url: url, TokenFile: missing}, wantErr: true},
+		"token directory": {opt: Options{Url: url, TokenFile: dir}, wantErr: true},
+		"token and file":  {opt: Options{Url: url, Token: "t", TokenFile: file}, wantErr: true},
+		"oauth2":          {opt: Options{Url: url, OAuth2IssuerUrl: "https://auth", OAuth2Audience: "a", OAuth2PrivateKey: file}, auth: true},
+		"oauth2 no key":   {opt: Options{Url: url, OAuth2IssuerUrl: "https://auth"}, wantErr: true},
+		"tls":             {opt: Options{Url: url, TLSCert: file, TLSKey: file, TLSTrustCertsFile: file}, auth: true},
+		"tls without key": {opt: Options{Url: url, TLSCert: file}, wantErr: true},
+		"tls and token":   {opt: Options{Url: url, Token: "t", TLSCert: file, TLSKey: file}, wantErr: true},
+		"oauth2 and tls":  {opt: Options{Url: url, OAuth2IssuerUrl: "https://auth", OAuth2PrivateKey: file, TLSKey: file}, wantErr: true},
+		"missing trust":   {opt: Options{Url: url, TLSTrustCertsFile: missing}, wantErr: true},
+	} {
+		co, err := clientOptions(tc.opt)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s:err=%v", name, err)
+			continue
+		}
+		if err == nil && (co.Authentication != nil) != tc.auth {
+			t.Errorf("%s:auth=%v", name, co.Authentication)
+		}
+	}
+	co, err := clientOptions(Options{Url: url, ConnectionTimeoutSecond: 3, OperationTimeoutSecond: 4, MaxConnectionsPerBroker: 2, ListenerName: "external", TLSTrustCertsFile: file, TLSValidateHostname: true, EnableTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if co.URL != url || co.ConnectionTimeout != 3*time.Second || co.OperationTimeout != 4*time.Second || co.MaxConnectionsPerBroker != 2 ||
+		co.ListenerName != "external" || co.TLSTrustCertsFilePath != file || !co.TLSValidateHostname || !co.EnableTransaction {
+		t.Errorf("client options=%+v", co)
+	}
+	if co, _ = clientOptions(Options{Url: url}); co.ConnectionTimeout != defaultConnectionTimeout || co.OperationTimeout != defaultOperationTimeout {
+		t.Errorf("default timeouts=%s,%s", co.ConnectionTimeout, co.OperationTimeout)
+	}
+}
+
+// producer 只记录 flush 和 close
+type producer struct {
+	pulsar.Producer
+	mu         sync.Mutex
+	events     []string
+	flushDelay time.Duration
+}
+
+func (p *producer) FlushWithCtx(ctx context.Context) error {
+	time.Sleep(p.flushDelay)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, "flush")
+	return nil
+}
+
+func (p *producer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, "close")
+}
+
+func (p *producer) closed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Equal(p.events, []string{"flush", "close"})
+}
+
+func waitClosed(t *testing.T, p *producer) {
+	for i := 0; i < 100 && !p.closed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !p.closed() {
+		t.Errorf("producer should be flushed and closed:%v", p.events)
+	}
+}
+
+func TestProducerCache(t *testing.T) {
+	c := newProducerCache(2, -1)
+	var created atomic.Int32
+	slowCreate := func() (pulsar.Producer, error) {
+		created.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		return &producer{}, nil
+	}
+	var wg sync.WaitGroup
+	results := make([]pulsar.Producer, 20)
+	for i := range results {
+		wg.Go(func() {
+			p, release, err := c.get("slow", slowCreate)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = p
+			release()
+		})
+	}
+	// 其他 topic 不被正在创建的 producer 阻塞
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	fast, release, err := c.get("fast", func() (pulsar.Producer, error) { return &producer{}, nil })
+	if err != nil || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("get fast=%s,%v", time.Since(start), err)
+	}
+	release()
+	wg.Wait()
+	if created.Load() != 1 {
+		t.Errorf("created=%d", created.Load())
+	}
+	for _, p := range results {
+		if p != results[0] {
+			t.Fatal("concurrent get should share producer")
+		}
+	}
+	if p, release, _ := c.get("fast", slowCreate); p != fast {
+		t.Error("cache hit should return cached producer")
+	} else {
+		release()
+	}
+
+	// 超过容量时移除最久未使用的 slow，使用中的 producer 在 release 后关闭
+	inUse, release, _ := c.get("slow", slowCreate)
+	time.Sleep(time.Millisecond)
+	if _, r, err := c.get("fast", slowCreate); err == nil {
+		r()
+	}
+	if _, r, err := c.get("third", func() (pulsar.Producer, error) { return &producer{}, nil }); err == nil {
+		r()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if inUse.(*producer).closed() || len(inUse.(*producer).events) > 0 {
+		t.Error("producer in use should not be closed")
+	}
+	release()
+	waitClosed(t, inUse.(*producer))
+
+	failed := errors.New("create failed")
+	if _, _, err = c.get("failed", func() (pulsar.Producer, error) { return nil, failed }); err != failed {
+		t.Errorf("err=%v", err)
+	}
+	if _, r, err := c.get("failed", func() (pulsar.Producer, error) { return &producer{}, nil }); err != nil {
+		t.Error("failed create should not be cached")
+	} else {
+		r()
+	}
+
+	c.close()
+	waitClosed(t, fast.(*producer))
+	if _, _, err = c.get("fast", slowCreate); err != errClientClosed {
+		t.Errorf("get after close=%v", err)
+	}
+
+	// close 返回时缓存中的 producer 已经 flush 并关闭
+	c = newProducerCache(2, -1)
+	p, release, err := c.get("flushing", func() (pulsar.Producer, error) { return &producer{flushDelay: 20 * time.Millisecond}, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	c.close()
+	if !p.(*producer).closed() {
+		t.Error("close should wait for producers to be closed")
+	}
+}
+
+// consumer 按顺序记录 ack、nack 和 close
+type consumer struct {
+	pulsar.Consumer
+	mu     sync.Mutex
+	events []string
+}
+
+func (c *consumer) record(event string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, event)
+}
+
+func (c *consumer) Subscription() string     { return "test" }
+func (c *consumer) Ack(pulsar.Message) error { c.record("ack"); return nil }
+func (c *consumer) Nack(pulsar.Message)      { c.record("nack") }
+func (c *consumer) Close()                   { c.record("close") }
+
+func TestCloseWhileBatching(t *testing.T) {
+	// 关闭与定时器触发的 flush 并发，处理中的批次必须在 consumer 关闭前确认
+	for i := range 200 {
+		c := &consumer{}
+		s := &Subscription{
+			pc:       &PulsarClient{},
+			consumer: c,
+			codec:    BytesCodec(),
+			opts: ConsumerOptions{Batch: &mqutil.BatchOptions{MaxSize: 100, MaxWait: time.Millisecond, Listener: func(ctx context.Context, msgs []*mq.Message) []error {
+				time.Sleep(time.Millisecond)
+				return nil
+			}}},
+			channel: make(chan pulsar.ConsumerMessage),
+			closing: make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+		go s.run()
+		s.channel <- pulsar.ConsumerMessage{Consumer: c, Message: &message{topic: "orders", payload: []byte("a")}}
+		time.Sleep(time.Duration(i%20) * 100 * time.Microsecond)
+		s.Close()
+		c.mu.Lock()
+		events := slices.Clone(c.events)
+		c.mu.Unlock()
+		if !slices.Equal(events, []string{"ack", "close"}) {
+			t.Fatalf("events=%v", events)
+		}
+	}
+}
+
+// client 只实现 reader 和事务
+type client struct {
+	pulsar.Client
+	readerOpts pulsar.ReaderOptions
+	reader     *reader
+	txns       []*transaction
+	commitErr  error
+}
+
+func (c *client) CreateReader(opts pulsar.ReaderOptions) (pulsar.Reader, error) {
+	c.readerOpts = opts
+	return c.reader, nil
+}
+
+type reader struct {
+	pulsar.Reader
+	msgs   []pulsar.Message
+	seekTo time.Time
+	closed bool
+}
+
+func (r *reader) HasNext() bool { return len(r.msgs) > 0 }
+func (r *reader) Close()        { r.closed = true }
+func (r *reader) SeekByTime(t time.Time) error {
+	r.seekTo = t
+	return nil
+}
+func (r *reader) Next(ctx context.Context) (pulsar.Message, error) {
+	if len(r.msgs) == 0 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	msg := r.msgs[0]
+	r.msgs = r.msgs[1:]
+	return msg, nil
+}
+
+func TestMessageId(t *testing.T) {
+	id := pulsar.EarliestMessageID()
+	parsed, err := ParseMessageId(EncodeMessageId(id))
+	if err != nil || parsed.String() != id.String() {
+		t.Errorf("parsed=%v,%v", parsed, err)
+	}
+	if _, err = ParseMessageId("not base64!"); err == nil {
+		t.Error("invalid message id should fail")
+	}
+}
+
+func TestRead(t *testing.T) {
+	pc := &PulsarClient{}
+	listener := func(ctx context.Context, msg *mq.Message) error { return nil }
+	for name, tc := range map[string]struct {
+		opts      ReaderOptions
+		start     pulsar.MessageID
+		inclusive bool
+		wantErr   bool
+	}{
+		"earliest":        {opts: ReaderOptions{Topic: "orders"}, start: pulsar.EarliestMessageID()},
+		"latest":          {opts: ReaderOptions{Topic: "orders", Start: StartLatest}, start: pulsar.LatestMessageID()},
+		"message id":      {opts: ReaderOptions{Topic: "orders", Start: StartMessageId, StartMessageId: pulsar.LatestMessageID(), StartInclusive: true}, start: pulsar.LatestMessageID(), inclusive: true},
+		"nil message id":  {opts: ReaderOptions{Topic: "orders", Start: StartMessageId}, wantErr: true},
+		"time from start": {opts: ReaderOptions{Topic: "orders", Start: StartTime}, start: pulsar.EarliestMessageID()},
+	} {
+		ro, codec, err := pc.readerOptions(tc.opts)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s:err=%v", name, err)
+			continue
+		}
+		if err == nil && (ro.StartMessageID.String() != tc.start.String() || ro.StartMessageIDInclusive != tc.inclusive || codec != DefaultCodec || ro.Schema != nil) {
+			t.Errorf("%s:reader options=%+v", name, ro)
+		}
+	}
+	if err := pc.Read(context.Background(), ReaderOptions{MessageListener: listener}); err == nil {
+		t.Error("empty topic should fail")
+	}
+	if err := pc.Read(context.Background(), ReaderOptions{Topic: "orders"}); err == nil {
+		t.Error("nil listener should fail")
+	}
+
+	r := &reader{msgs: []pulsar.Message{&message{topic: "orders", payload: []byte("a")}, &message{topic: "orders", payload: []byte("b")}}}
+	pc = &PulsarClient{client: &client{reader: r}}
+	start := time.Now().Add(-time.Hour)
+	var read []string
+	err := pc.Read(context.Background(), ReaderOptions{Topic: "orders", Start: StartTime, StartTime: start, StopAtEnd: true, Codec: BytesCodec(), MessageListener: func(ctx context.Context, msg *mq.Message) error {
+		if len(msg.Header[MessageIdHeader]) == 0 {
+			t.Error("message id header is empty")
+		}
+		read = append(read, string(msg.Payload))
+		return nil
+	}})
+	if err != nil || !r.seekTo.Equal(start) || !r.closed || !slices.Equal(read, []string{"a", "b"}) {
+		t.Errorf("read=%v,seek=%s,closed=%v,err=%v", read, r.seekTo, r.closed, err)
+	}
+
+	failed := errors.New("failed")
+	r = &reader{msgs: []pulsar.Message{&message{topic: "orders", payload: []byte("a")}, &message{topic: "orders", payload: []byte("b")}}}
+	pc = &PulsarClient{client: &client{reader: r}}
+	if err = pc.Read(context.Background(), ReaderOptions{Topic: "orders", Codec: BytesCodec(), MessageListener: func(ctx context.Context, msg *mq.Message) error {
+		return failed
+	}}); err != failed || len(r.msgs) != 1 {
+		t.Errorf("listener error should stop reading:%v,%d", err, len(r.msgs))
+	}
+	if err = pc.Read(context.Background(), ReaderOptions{Topic: "orders", Codec: BytesCodec(), MessageListener: func(ctx context.Context, msg *mq.Message) error {
+		panic("boom")
+	}}); err == nil {
+		t.Error("listener panic should stop reading")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = pc.Read(ctx, ReaderOptions{Topic: "orders", Codec: BytesCodec(), MessageListener: listener}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ctx err=%v", err)
+	}
+}
+
+func (c *consumer) Seek(pulsar.MessageID) error { c.record("seek"); return nil }
+func (c *consumer) SeekByTime(time.Time) error  { c.record("seekByTime"); return nil }
+
+func TestSubscriptionSeek(t *testing.T) {
+	c := &consumer{}
+	s := &Subscription{consumer: c}
+	s.Seek(pulsar.EarliestMessageID())
+	s.SeekByTime(time.Now())
+	if !slices.Equal(c.events, []string{"seek", "seekByTime"}) {
+		t.Errorf("events=%v", c.events)
+	}
+}
+
+func TestCheckTopics(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts    ConsumerOptions
+		wantErr bool
+	}{
+		"empty":           {opts: ConsumerOptions{}, wantErr: true},
+		"topic":           {opts: ConsumerOptions{ConsumerOptions: mq.ConsumerOptions{Topic: "orders"}}},
+		"topics":          {opts: ConsumerOptions{Topics: []string{"orders", "payments"}}},
+		"pattern":         {opts: ConsumerOptions{TopicsPattern: "persistent://public/default/audit-.*"}},
+		"topic and list":  {opts: ConsumerOptions{ConsumerOptions: mq.ConsumerOptions{Topic: "orders"}, Topics: []string{"payments"}}, wantErr: true},
+		"list and regexp": {opts: ConsumerOptions{Topics: []string{"orders"}, TopicsPattern: "audit-.*"}, wantErr: true},
+	} {
+		if err := checkTopics(tc.opts); (err != nil) != tc.wantErr {
+			t.Errorf("%s:err=%v", name, err)
+		}
+	}
+}
+
+func TestTopicCodec(t *testing.T) {
+	for topic, want := range map[string]string{
+		"orders":                              "persistent://public/default/orders",
+		"a/x/orders":                          "persistent://a/x/orders",
+		"persistent://a/x/orders-partition-3": "persistent://a/x/orders",
+		"non-persistent://a/x/orders":         "non-persistent://a/x/orders",
+		"persistent://public/default/orders-partition": "persistent://public/default/orders-partition",
+	} {
+		if key := topicKey(topic); key != want {
+			t.Errorf("topicKey(%s)=%s,want %s", topic, key, want)
+		}
+	}
+	pc := &PulsarClient{}
+	pc.RegisterCodec("orders", BytesCodec())
+	c := &topicCodec{pc: pc}
+	raw := []byte{0, 1}
+	if payload, err := c.Decode(&message{topic: "persistent://public/default/orders-partition-1", payload: raw}); err != nil || !bytes.Equal(payload, raw) {
+		t.Errorf("registered codec payload=%v,%v", payload, err)
+	}
+	if payload, err := c.Decode(sent(t, DefaultCodec, []byte("a"))); err != nil || string(payload) != "a" {
+		t.Errorf("default codec payload=%s,%v", payload, err)
+	}
+}
+
+func (c *client) NewTransaction(timeout time.Duration) (pulsar.Transaction, error) {
+	txn := &transaction{commitErr: c.commitErr}
+	c.txns = append(c.txns, txn)
+	return txn, nil
+}
+
+type transaction struct {
+	pulsar.Transaction
+	state     string
+	commitErr error
+}
+
+func (t *transaction) Commit(context.Context) error {
+	if t.commitErr != nil {
+		return t.commitErr
+	}
+	t.state = "committed"
+	return nil
+}
+
+func (t *transaction) Abort(context.Context) error {
+	t.state = "aborted"
+	return nil
+}
+
+func (c *consumer) AckWithTxn(pulsar.Message, pulsar.Transaction) error {
+	c.record("ackTxn")
+	return nil
+}
+
+func TestConsumeTxn(t *testing.T) {
+	ok := func(ctx context.Context, txn *Txn, msg *mq.Message) error { return nil }
+	for name, tc := range map[string]struct {
+		listener  TxnListener
+		commitErr error
+		state     string
+		events    []string
+	}{
+		"commit": {listener: ok, state: "committed", events: []string{"ackTxn"}},
+		"abort": {listener: func(ctx context.Context, txn *Txn, msg *mq.Message) error {
+			return errors.New("failed")
+		}, state: "aborted", events: []string{"nack"}},
+		"panic":        {listener: func(ctx context.Context, txn *Txn, msg *mq.Message) error { panic("boom") }, state: "aborted", events: []string{"nack"}},
+		"commit error": {listener: ok, commitErr: errors.New("commit failed"), state: "aborted", events: []string{"ackTxn", "nack"}},
+	} {
+		cl, c := &client{commitErr: tc.commitErr}, &consumer{}
+		pc := &PulsarClient{client: cl}
+		opts := ConsumerOptions{ConsumerOptions: mq.ConsumerOptions{Topic: "orders", ACKMode: mq.ACK_MANUAL, RetryTimes: 3}, TxnListener: tc.listener}
+		consumeTxn(pc, pulsar.ConsumerMessage{Consumer: c, Message: &message{topic: "orders", payload: []byte("a")}}, c, BytesCodec(), opts)
+		if len(cl.txns) != 1 || cl.txns[0].state != tc.state || !slices.Equal(c.events, tc.events) {
+			t.Errorf("%s:txns=%v,events=%v", name, cl.txns, c.events)
+		}
+	}
+}
+
+// panicCodec 解码时 panic
+type panicCodec struct {
+	Codec
+}
+
+func (panicCodec) Decode(pulsar.Message) ([]byte, error) {
+	panic("decode")
+}
+
+func TestConsumeTxnDecodePanic(t *testing.T) {
+	cl, c := &client{}, &consumer{}
+	opts := ConsumerOptions{ConsumerOptions: mq.ConsumerOptions{Topic: "orders"}, TxnListener: func(ctx context.Context, txn *Txn, msg *mq.Message) error { return nil }}
+	consumeTxn(&PulsarClient{client: cl}, pulsar.ConsumerMessage{Consumer: c, Message: &message{topic: "orders"}}, c, panicCodec{}, opts)
+	if len(cl.txns) != 0 {
+		t.Errorf("txns=%v", cl.txns)
+	}
+}
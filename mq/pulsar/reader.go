@@ -0,0 +1,162 @@
+package pulsar
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/mq"
+	"github.com/skirrund/gcloud/tracer"
+)
+
+// MessageIdHeader 消费和读取时写入 header 的消息 ID，可通过 ParseMessageId 还原后用于 Reader 或 Seek，发送时忽略
+const MessageIdHeader = "Pulsar-Message-Id"
+
+type StartPosition int
+
+const (
+	StartEarliest StartPosition = iota
+	StartLatest
+	// StartMessageId 从 ReaderOptions.StartMessageId 开始
+	StartMessageId
+	// StartTime 从 publish time 不早于 ReaderOptions.StartTime 的消息开始
+	StartTime
+)
+
+// ReaderOptions 不创建订阅、不确认消息，按顺序读取 topic
+type ReaderOptions struct {
+	Topic          string
+	Start          StartPosition
+	StartMessageId pulsar.MessageID
+	// StartInclusive StartMessageId 时是否包含该消息
+	StartInclusive bool
+	StartTime      time.Time
+	// StopAtEnd 为 true 时读到创建时的最新消息后返回，否则持续读取直到 ctx 结束
+	StopAtEnd bool
+	// MessageListener 返回错误时停止读取并返回该错误
+	MessageListener func(ctx context.Context, message *mq.Message) error
+	// Codec 为空时使用 RegisterCodec 指定的 codec，否则使用 DefaultCodec
+	Codec Codec
+	Log   *mqutil.LogOptions
+}
+
+func EncodeMessageId(id pulsar.MessageID) string {
+	return base64.StdEncoding.EncodeToString(id.Serialize())
+}
+
+func ParseMessageId(s string) (pulsar.MessageID, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("[pulsar] invalid message id:" + err.Error())
+	}
+	return pulsar.DeserializeMessageID(data)
+}
+
+// Read 按 ReaderOptions 读取 topic 并交给 MessageListener 处理，阻塞直到 ctx 结束、读到末尾或处理出错
+func (pc *PulsarClient) Read(ctx context.Context, opts ReaderOptions) error {
+	if len(opts.Topic) == 0 {
+		return errors.New("[pulsar] topic is empty")
+	}
+	if opts.MessageListener == nil {
+		return errors.New("[pulsar] reader MessageListener is nil")
+	}
+	ro, codec, err := pc.readerOptions(opts)
+	if err != nil {
+		return err
+	}
+	reader, err := pc.client.CreateReader(ro)
+	if err != nil {
+		return errors.New("[pulsar] create reader error:" + err.Error())
+	}
+	defer reader.Close()
+	if opts.Start == StartTime {
+		if err = reader.SeekByTime(opts.StartTime); err != nil {
+			return errors.New("[pulsar] reader seek error:" + err.Error())
+		}
+	}
+	logger.Infof("[pulsar]start read topic:%s,start:%d", opts.Topic, opts.Start)
+	for {
+		if opts.StopAtEnd && !reader.HasNext() {
+			logger.Info("[pulsar]reader reached end:", opts.Topic)
+			return nil
+		}
+		msg, err := reader.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if err = readMsg(msg, codec, opts); err != nil {
+			return err
+		}
+	}
+}
+
+// readerOptions 转换起始位置并选择 codec，StartTime 在创建 reader 后 seek
+func (pc *PulsarClient) readerOptions(opts ReaderOptions) (pulsar.ReaderOptions, Codec, error) {
+	ro := pulsar.ReaderOptions{
+		Topic:          opts.Topic,
+		Name:           getAppName(pc.appName),
+		StartMessageID: pulsar.EarliestMessageID(),
+	}
+	switch opts.Start {
+	case StartLatest:
+		ro.StartMessageID = pulsar.LatestMessageID()
+	case StartMessageId:
+		if opts.StartMessageId == nil {
+			return ro, nil, errors.New("[pulsar] reader StartMessageId is nil")
+		}
+		ro.StartMessageID = opts.StartMessageId
+		ro.StartMessageIDInclusive = opts.StartInclusive
+	}
+	codec := opts.Codec
+	if codec == nil {
+		codec = pc.codec(opts.Topic)
+	}
+	if _, ok := codec.(*jsonStringCodec); !ok {
+		ro.Schema = codec.Schema()
+	}
+	return ro, codec, nil
+}
+
+func readMsg(msg pulsar.Message, codec Codec, opts ReaderOptions) (err error) {
+	logCtx := tracer.NewTraceIDContext()
+	defer func() {
+		if e := recover(); e != nil {
+			logger.ErrorContext(logCtx, "[pulsar] reader panic recover :", e, "\n", string(debug.Stack()))
+			err = errors.New(fmt.Sprint("[pulsar] reader panic:", e))
+		}
+	}()
+	payload, err := codec.Decode(msg)
+	if err != nil {
+		return errors.New("[pulsar] reader decode error:" + err.Error())
+	}
+	if logOpts := mqutil.OrDefault(opts.Log); logOpts.Sampled() {
+		logger.InfofContext(logCtx, "[pulsar] reader info=>topic:%s,msgId:%v,publishTime:%v", msg.Topic(), msg.ID(), msg.PublishTime())
+		logger.InfoContext(logCtx, "[pulsar] reader msg:", logOpts.Format(payload))
+	}
+	return opts.MessageListener(logCtx, &mq.Message{
+		Topic:   msg.Topic(),
+		Payload: payload,
+		Header:  toMqHeader(msg),
+	})
+}
+
+// SeekByTime 将订阅的消费位置重置到指定的 publish time，之后的消息会重新投递
+func (s *Subscription) SeekByTime(t time.Time) error {
+	logger.Info("[pulsar]seek subscription:", s.opts.SubscriptionName, ",time:", t.Format(time.DateTime))
+	return s.consumer.SeekByTime(t)
+}
+
+// Seek 将订阅的消费位置重置到指定消息，不支持多 topic 订阅
+func (s *Subscription) Seek(id pulsar.MessageID) error {
+	logger.Info("[pulsar]seek subscription:", s.opts.SubscriptionName, ",msgId:", id.String())
+	return s.consumer.Seek(id)
+}
@@ -0,0 +1,113 @@
+package pulsar
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/logger"
+)
+
+// Subscription 一个订阅的句柄，Close/Unsubscribe 会先停止接收新消息并等待处理中的消息完成
+type Subscription struct {
+	pc        *PulsarClient
+	consumer  pulsar.Consumer
+	codec     Codec
+	opts      ConsumerOptions
+	channel   chan pulsar.ConsumerMessage
+	sem       chan struct{}
+	wg        sync.WaitGroup
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Consumer 返回底层 pulsar.Consumer
+func (s *Subscription) Consumer() pulsar.Consumer {
+	return s.consumer
+}
+
+func (s *Subscription) run() {
+	defer close(s.done)
+	if s.opts.Batch != nil {
+		s.runBatch()
+		return
+	}
+	for {
+		select {
+		case <-s.closing:
+			return
+		case cm := <-s.channel:
+			select {
+			case s.sem <- struct{}{}:
+			case <-s.closing:
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer func() {
+					<-s.sem
+					s.wg.Done()
+				}()
+				if s.opts.TxnListener != nil {
+					consumeTxn(s.pc, cm, s.consumer, s.codec, s.opts)
+				} else {
+					consume(cm, s.consumer, s.codec, s.opts)
+				}
+			}()
+		}
+	}
+}
+
+func (s *Subscription) runBatch() {
+	bo := s.opts.Batch.WithDefaults()
+	// 每条消息在加入 Batcher 前计数，定时器协程中的 flush 完成前 drain 不会返回
+	b := mqutil.NewBatcher(bo.MaxSize, bo.MaxWait, func(cms []pulsar.ConsumerMessage) {
+		defer s.wg.Add(-len(cms))
+		consumeBatch(cms, s.consumer, s.codec, s.opts, bo.Listener)
+	})
+	for {
+		select {
+		case <-s.closing:
+			b.Flush()
+			return
+		case cm := <-s.channel:
+			s.wg.Add(1)
+			b.Add(cm)
+		}
+	}
+}
+
+// drain 停止接收新消息并等待处理中的消息完成，未分发的消息在 consumer 关闭后由 broker 重新投递
+func (s *Subscription) drain() bool {
+	first := false
+	s.closeOnce.Do(func() {
+		first = true
+		close(s.closing)
+		<-s.done
+		s.wg.Wait()
+		s.pc.subs.Delete(s)
+	})
+	return first
+}
+
+func (s *Subscription) Close() error {
+	if !s.drain() {
+		return nil
+	}
+	logger.Info("[pulsar]close subscription:", s.opts.Topic, ":", s.opts.SubscriptionName)
+	s.consumer.Close()
+	return nil
+}
+
+// Unsubscribe 取消订阅并关闭 consumer，broker 会删除该订阅
+func (s *Subscription) Unsubscribe() error {
+	if !s.drain() {
+		return errors.New("[pulsar] subscription already closed")
+	}
+	logger.Info("[pulsar]unsubscribe:", s.opts.Topic, ":", s.opts.SubscriptionName)
+	err := s.consumer.Unsubscribe()
+	s.consumer.Close()
+	return err
+}
@@ -0,0 +1,126 @@
+package pulsar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/skirrund/gcloud-plugins/mq/mqutil"
+	"github.com/skirrund/gcloud/logger"
+	"github.com/skirrund/gcloud/mq"
+	"github.com/skirrund/gcloud/tracer"
+)
+
+const DefaultTxnTimeout = time.Minute
+
+// TxnListener 在事务中处理消息，通过 txn.Send 发送的消息与消费确认在返回 nil 后一起提交，返回错误时回滚
+type TxnListener func(ctx context.Context, txn *Txn, message *mq.Message) error
+
+// Txn pulsar 事务，需要配置 pulsar.enableTransaction=true
+type Txn struct {
+	pc  *PulsarClient
+	txn pulsar.Transaction
+}
+
+// BeginTxn timeout 为事务超时时间，未提交的事务超时后由 broker 回滚，小于等于0时使用 DefaultTxnTimeout
+func (pc *PulsarClient) BeginTxn(timeout time.Duration) (*Txn, error) {
+	if timeout <= 0 {
+		timeout = DefaultTxnTimeout
+	}
+	txn, err := pc.client.NewTransaction(timeout)
+	if err != nil {
+		return nil, errors.New("[pulsar] begin transaction error:" + err.Error())
+	}
+	return &Txn{pc: pc, txn: txn}, nil
+}
+
+// Raw 返回底层 pulsar.Transaction
+func (t *Txn) Raw() pulsar.Transaction {
+	return t.txn
+}
+
+// Send 在事务中发送消息，提交前对消费者不可见
+func (t *Txn) Send(ctx context.Context, msg *mq.Message) error {
+	topic := msg.Topic
+	if len(topic) == 0 {
+		return errors.New("[pulsar] topic is empty")
+	}
+	message := createMsg(msg, t.pc.codec(topic))
+	message.Transaction = t.txn
+	producer, release, err := t.pc.getProducer(topic)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	_, err = producer.Send(ctx, message)
+	release()
+	mqutil.Metrics.Published(mqutil.SystemPulsar, topic, start, err)
+	if isFatalProducerError(err) {
+		t.pc.producers.remove(topic, producer)
+	}
+	return err
+}
+
+// Ack 在事务中确认消息，事务回滚后消息会重新投递
+func (t *Txn) Ack(consumer pulsar.Consumer, msg pulsar.Message) error {
+	return consumer.AckWithTxn(msg, t.txn)
+}
+
+func (t *Txn) Commit(ctx context.Context) error {
+	return t.txn.Commit(ctx)
+}
+
+func (t *Txn) Abort(ctx context.Context) error {
+	return t.txn.Abort(ctx)
+}
+
+// WithTxn 开启事务执行 fn，fn 返回 nil 时提交，否则回滚；提交失败时同样回滚，避免事务等到超时才结束
+func (pc *PulsarClient) WithTxn(ctx context.Context, timeout time.Duration, fn func(txn *Txn) error) error {
+	txn, err := pc.BeginTxn(timeout)
+	if err != nil {
+		return err
+	}
+	if err = fn(txn); err == nil {
+		if err = txn.Commit(ctx); err == nil {
+			return nil
+		}
+		logger.ErrorContext(ctx, "[pulsar] commit transaction error:", err.Error())
+	}
+	if e := txn.Abort(ctx); e != nil {
+		logger.ErrorContext(ctx, "[pulsar] abort transaction error:", e.Error())
+	}
+	return err
+}
+
+// consumeTxn 在事务中处理并确认消息，失败时回滚事务后按普通失败处理
+func consumeTxn(pc *PulsarClient, cm pulsar.ConsumerMessage, consumer pulsar.Consumer, codec Codec, opts ConsumerOptions) {
+	logCtx := tracer.NewTraceIDContext()
+	defer func() {
+		if err := recover(); err != nil {
+			logger.ErrorContext(logCtx, "[pulsar] txn consumer panic recover :", err, "\n", string(debug.Stack()))
+		}
+	}()
+	m := decodeMsg(logCtx, cm, codec, opts)
+	start := time.Now()
+	err := pc.WithTxn(logCtx, opts.TxnTimeout, func(txn *Txn) (err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				logger.ErrorContext(logCtx, "[pulsar] txn consumer panic recover :", e, "\n", string(debug.Stack()))
+				err = errors.New(fmt.Sprint("[pulsar] txn consumer panic:", e))
+			}
+		}()
+		if err = opts.TxnListener(logCtx, txn, m); err != nil {
+			return err
+		}
+		return txn.Ack(consumer, cm.Message)
+	})
+	mqutil.Metrics.Handled(mqutil.SystemPulsar, opts.Topic, opts.SubscriptionName, start, err)
+	if err == nil {
+		mqutil.Metrics.Acked(mqutil.SystemPulsar, opts.Topic, opts.SubscriptionName)
+		return
+	}
+	finish(logCtx, cm, consumer, codec, opts, err)
+}